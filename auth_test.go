@@ -0,0 +1,174 @@
+// Copyright (c) 2024 Elaunira
+// SPDX-License-Identifier: MPL-2.0
+
+package clickhouse
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	clickhousehelper "github.com/elaunira/openbao-plugin-database-clickhouse/testhelpers/clickhouse"
+	"github.com/openbao/openbao/sdk/v2/database/dbplugin/v5"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_validateAuthType(t *testing.T) {
+	require.NoError(t, validateAuthType(""))
+	for _, authType := range authTypes {
+		require.NoError(t, validateAuthType(authType))
+	}
+	require.Error(t, validateAuthType("bcrypt"))
+}
+
+func Test_identifiedClause(t *testing.T) {
+	require.Equal(t, "IDENTIFIED BY '{{password}}'", identifiedClause(""))
+	require.Equal(t, "IDENTIFIED WITH sha256_password BY '{{password}}'", identifiedClause(authSHA256Password))
+	require.Equal(t, "IDENTIFIED WITH sha256_hash BY '{{password_hash}}' SALT '{{password_salt}}'", identifiedClause(authSHA256Hash))
+	require.Equal(t, "IDENTIFIED WITH ldap SERVER '{{ldap_server}}'", identifiedClause(authLDAP))
+	require.Equal(t, "IDENTIFIED WITH kerberos", identifiedClause(authKerberos))
+}
+
+func Test_passwordValues(t *testing.T) {
+	values, err := passwordValues(authSHA256Hash, "s3cr3t")
+	require.NoError(t, err)
+	require.Equal(t, authSHA256Hash, values["auth_type"])
+	require.Len(t, values["password_salt"], 2*saltLength)
+	sum := sha256.Sum256([]byte("s3cr3t" + values["password_salt"]))
+	require.Equal(t, hex.EncodeToString(sum[:]), values["password_hash"])
+
+	// Each call uses a new salt
+	again, err := passwordValues(authSHA256Hash, "s3cr3t")
+	require.NoError(t, err)
+	require.NotEqual(t, values["password_salt"], again["password_salt"])
+
+	// Other auth types get an unsalted hash
+	values, err = passwordValues(authPlaintextPassword, "s3cr3t")
+	require.NoError(t, err)
+	require.Empty(t, values["password_salt"])
+	sum = sha256.Sum256([]byte("s3cr3t"))
+	require.Equal(t, hex.EncodeToString(sum[:]), values["password_hash"])
+}
+
+func TestClickhouse_DryRunNewUser_AuthType(t *testing.T) {
+	db := newTestClickhouse(t)
+	require.NoError(t, db.Init(context.Background(), map[string]interface{}{
+		"connection_url":  "clickhouse://localhost:9000",
+		"auth_type":       authSHA256Hash,
+		"creation_config": map[string]interface{}{"roles": []string{"reader"}},
+	}, false))
+
+	result, err := db.DryRunNewUser(dbplugin.NewUserRequest{
+		UsernameConfig: dbplugin.UsernameMetadata{DisplayName: "token", RoleName: "reader"},
+		Password:       "s3cr3t-pass",
+		Expiration:     time.Now().Add(time.Hour),
+	})
+	require.NoError(t, err)
+	require.Contains(t, result.Statements[0], "IDENTIFIED WITH sha256_hash BY '[password_hash]' SALT '")
+	require.NotContains(t, result.Statements[0], "s3cr3t-pass")
+
+	// The hash is masked like the password, whichever auth_type produced it
+	require.NoError(t, db.Init(context.Background(), map[string]interface{}{
+		"connection_url": "clickhouse://localhost:9000",
+	}, false))
+	sum := sha256.Sum256([]byte("s3cr3t-pass"))
+	result, err = db.DryRunNewUser(dbplugin.NewUserRequest{
+		UsernameConfig: dbplugin.UsernameMetadata{DisplayName: "token", RoleName: "reader"},
+		Statements: dbplugin.Statements{
+			Commands: []string{"CREATE USER '{{name}}' IDENTIFIED WITH sha256_hash BY '{{password_hash}}'"},
+		},
+		Password:   "s3cr3t-pass",
+		Expiration: time.Now().Add(time.Hour),
+	})
+	require.NoError(t, err)
+	require.Contains(t, result.Statements[0], "BY '[password_hash]'")
+	require.NotContains(t, result.Statements[0], hex.EncodeToString(sum[:]))
+
+	err = db.Init(context.Background(), map[string]interface{}{
+		"connection_url": "clickhouse://localhost:9000",
+		"auth_type":      "bcrypt",
+	}, false)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid auth_type")
+}
+
+func TestClickhouse_NewUser_SHA256Hash(t *testing.T) {
+	cleanup, connURL := clickhousehelper.PrepareTestContainer(t, false, testAdminUser, testAdminPassword)
+	defer cleanup()
+
+	db := newTestClickhouse(t)
+	_, err := db.Initialize(context.Background(), dbplugin.InitializeRequest{
+		Config: map[string]interface{}{
+			"connection_url": connURL,
+			"auth_type":      authSHA256Hash,
+		},
+		VerifyConnection: true,
+	})
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+
+	resp, err := db.NewUser(context.Background(), dbplugin.NewUserRequest{
+		UsernameConfig: dbplugin.UsernameMetadata{DisplayName: "token", RoleName: testRole},
+		Statements: dbplugin.Statements{
+			Commands: []string{
+				"CREATE USER '{{name}}' IDENTIFIED WITH {{auth_type}} BY '{{password_hash}}' SALT '{{password_salt}}'",
+			},
+		},
+		Password:   testPassword,
+		Expiration: time.Now().Add(time.Hour),
+	})
+	require.NoError(t, err)
+
+	// The server only received the hash, yet the password logs in
+	require.NoError(t, clickhousehelper.TestCredsExist(t, buildTestConnURL(connURL, resp.Username, testPassword)))
+
+	// Rotation without statements keeps using the hashed form
+	newPassword := testPassword + "-rotated"
+	_, err = db.UpdateUser(context.Background(), dbplugin.UpdateUserRequest{
+		Username: resp.Username,
+		Password: &dbplugin.ChangePassword{NewPassword: newPassword},
+	})
+	require.NoError(t, err)
+	require.NoError(t, clickhousehelper.TestCredsExist(t, buildTestConnURL(connURL, resp.Username, newPassword)))
+}
+
+func TestClickhouse_DryRunNewUser_LDAP(t *testing.T) {
+	db := newTestClickhouse(t)
+	require.NoError(t, db.Init(context.Background(), map[string]interface{}{
+		"connection_url":  "clickhouse://localhost:9000",
+		"auth_type":       authLDAP,
+		"ldap_server":     "corp_ldap",
+		"creation_config": map[string]interface{}{"roles": []string{"reader"}},
+	}, false))
+
+	// No password is needed for externally authenticated users
+	result, err := db.DryRunNewUser(dbplugin.NewUserRequest{
+		UsernameConfig: dbplugin.UsernameMetadata{DisplayName: "token", RoleName: "reader"},
+		Expiration:     time.Now().Add(time.Hour),
+	})
+	require.NoError(t, err)
+	require.Contains(t, result.Statements[0], "IDENTIFIED WITH ldap SERVER 'corp_ldap'")
+
+	err = newTestClickhouse(t).Init(context.Background(), map[string]interface{}{
+		"connection_url": "clickhouse://localhost:9000",
+		"auth_type":      authLDAP,
+	}, false)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "ldap_server is required")
+}
+
+func TestClickhouse_DryRunNewUser_EmptyPassword(t *testing.T) {
+	db := newTestClickhouse(t)
+	require.NoError(t, db.Init(context.Background(), map[string]interface{}{
+		"connection_url":  "clickhouse://localhost:9000",
+		"creation_config": map[string]interface{}{"roles": []string{"reader"}},
+	}, false))
+
+	_, err := db.DryRunNewUser(dbplugin.NewUserRequest{
+		UsernameConfig: dbplugin.UsernameMetadata{DisplayName: "token", RoleName: "reader"},
+		Expiration:     time.Now().Add(time.Hour),
+	})
+	require.ErrorIs(t, err, ErrEmptyPassword)
+}
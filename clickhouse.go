@@ -5,12 +5,20 @@
 package clickhouse
 
 import (
+	"cmp"
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"maps"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
+	metrics "github.com/armon/go-metrics"
+	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/go-secure-stdlib/strutil"
 	"github.com/openbao/openbao/sdk/v2/database/dbplugin/v5"
 	"github.com/openbao/openbao/sdk/v2/database/helper/dbutil"
@@ -24,6 +32,10 @@ const (
 	defaultUserNameTemplate = `{{ printf "v-%s-%s-%s-%s" (.DisplayName | truncate 8) (.RoleName | truncate 8) (random 15) (unix_time) | truncate 32 }}`
 
 	defaultRevocationStatement        = `DROP USER IF EXISTS '{{name}}'`
+	clusterRevocationStatement        = `DROP USER IF EXISTS '{{name}}' ON CLUSTER '{{cluster}}'`
+	revokeAllPrivilegesStatement      = `REVOKE ALL PRIVILEGES ON *.* FROM '{{name}}'`
+	killQueriesStatement              = `KILL QUERY WHERE user = '%s' ASYNC`
+	autoExpireStatement               = `ALTER USER '{{name}}' VALID UNTIL '{{expiration}}'`
 	defaultRotateCredentialsStatement = `ALTER USER IF EXISTS '{{name}}' IDENTIFIED BY '{{password}}'` //nolint:gosec // Not hardcoded credentials, SQL template
 )
 
@@ -35,37 +47,99 @@ type UsernameMetadata struct {
 	RoleName    string
 }
 
+// unknownBuildValue is reported for build information that was not provided.
+const unknownBuildValue = "unknown"
+
+// BuildInfo describes the build of the plugin binary.
+type BuildInfo struct {
+	Version string
+	Commit  string
+	Date    string
+}
+
+// withDefaults returns a copy of the build info with missing commit and date
+// reported as unknown.
+func (b BuildInfo) withDefaults() BuildInfo {
+	if b.Commit == "" {
+		b.Commit = unknownBuildValue
+	}
+	if b.Date == "" {
+		b.Date = unknownBuildValue
+	}
+	return b
+}
+
 // Clickhouse is the database plugin implementation for ClickHouse.
 type Clickhouse struct {
 	*clickhouseConnectionProducer
 	usernameProducer template.StringTemplate
-	version          string
+	buildInfo        BuildInfo
+	metrics          *metrics.Metrics
 }
 
 // New returns a new Clickhouse instance with the provided username template and version.
 func New(usernameTemplate, version string) func() (interface{}, error) {
-	return func() (interface{}, error) {
-		if usernameTemplate == "" {
-			usernameTemplate = defaultUserNameTemplate
-		}
+	return NewWithBuildInfo(usernameTemplate, BuildInfo{Version: version})
+}
+
+// NewWithBuildInfo returns a new Clickhouse instance with the provided
+// username template and build information.
+func NewWithBuildInfo(usernameTemplate string, info BuildInfo) func() (interface{}, error) {
+	return NewWithLogger(usernameTemplate, info, nil)
+}
 
-		up, err := template.NewTemplate(template.Template(usernameTemplate))
+// NewWithLogger is NewWithBuildInfo logging to logger. A nil logger discards
+// all output.
+func NewWithLogger(usernameTemplate string, info BuildInfo, logger hclog.Logger) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		db, err := newClickhouse(usernameTemplate, info)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse username template: %w", err)
+			return nil, err
 		}
-
-		db := &Clickhouse{
-			clickhouseConnectionProducer: &clickhouseConnectionProducer{},
-			usernameProducer:             up,
-			version:                      version,
+		if logger != nil {
+			db.WithLogger(logger)
 		}
 
-		wrapped := dbplugin.NewDatabaseErrorSanitizerMiddleware(db, db.secretValues)
+		wrapped := dbplugin.NewDatabaseErrorSanitizerMiddleware(db, db.SecretValues)
 
 		return wrapped, nil
 	}
 }
 
+// newClickhouse returns the unwrapped Clickhouse instance built by
+// NewWithBuildInfo.
+func newClickhouse(usernameTemplate string, info BuildInfo) (*Clickhouse, error) {
+	if usernameTemplate == "" {
+		usernameTemplate = defaultUserNameTemplate
+	}
+
+	up, err := template.NewTemplate(template.Template(usernameTemplate))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse username template: %w", err)
+	}
+
+	m, err := newMetrics(&metrics.BlackholeSink{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up metrics: %w", err)
+	}
+
+	db := &Clickhouse{
+		clickhouseConnectionProducer: &clickhouseConnectionProducer{clientVersion: info.Version},
+		usernameProducer:             up,
+		buildInfo:                    info.withDefaults(),
+		metrics:                      m,
+	}
+	db.WithLogger(hclog.NewNullLogger())
+
+	return db, nil
+}
+
+// WithLogger sets the logger used by the plugin. Log entries never include
+// passwords.
+func (c *Clickhouse) WithLogger(logger hclog.Logger) {
+	c.logger = logger
+}
+
 // DefaultUserNameTemplate returns the default username template.
 func DefaultUserNameTemplate() string {
 	return defaultUserNameTemplate
@@ -76,18 +150,32 @@ func (c *Clickhouse) Type() (string, error) {
 	return clickhouseTypeName, nil
 }
 
-// Metadata returns the plugin metadata.
+// Metadata returns the plugin metadata, including the build commit and date,
+// whether the plugin is initialized, and the server version once a verified
+// connection has detected it.
 func (c *Clickhouse) Metadata() (map[string]interface{}, error) {
-	return map[string]interface{}{
-		"version": c.version,
-		"type":    clickhouseTypeName,
-	}, nil
+	c.Lock()
+	defer c.Unlock()
+
+	metadata := map[string]interface{}{
+		"version":     c.buildInfo.Version,
+		"commit":      c.buildInfo.Commit,
+		"build_date":  c.buildInfo.Date,
+		"type":        clickhouseTypeName,
+		"initialized": c.initialized,
+	}
+	if c.version != "" {
+		metadata["server_version"] = c.version
+	}
+	return metadata, nil
 }
 
-// PluginVersion returns the version of the plugin.
+// PluginVersion returns the version of the plugin. Only the version is
+// reported, as OpenBao compares it with the version the plugin was registered
+// with; the commit and build date are available from Metadata.
 func (c *Clickhouse) PluginVersion() logical.PluginVersion {
 	return logical.PluginVersion{
-		Version: c.version,
+		Version: c.buildInfo.Version,
 	}
 }
 
@@ -106,6 +194,16 @@ func (c *Clickhouse) Initialize(ctx context.Context, req dbplugin.InitializeRequ
 	if err != nil {
 		return dbplugin.InitializeResponse{}, fmt.Errorf("failed to parse username_template: %w", err)
 	}
+
+	// Render a sample so a template producing unusable names fails here
+	// rather than on the first credential request
+	sample, err := up.Generate(UsernameMetadata{DisplayName: "token", RoleName: "role"})
+	if err != nil {
+		return dbplugin.InitializeResponse{}, fmt.Errorf("failed to render username_template: %w", err)
+	}
+	if err := validateUsername(sample); err != nil {
+		return dbplugin.InitializeResponse{}, fmt.Errorf("invalid username_template: %w", err)
+	}
 	c.usernameProducer = up
 
 	err = c.Init(ctx, req.Config, req.VerifyConnection)
@@ -122,52 +220,192 @@ func (c *Clickhouse) Initialize(ctx context.Context, req dbplugin.InitializeRequ
 
 // NewUser creates a new user in the ClickHouse database.
 func (c *Clickhouse) NewUser(ctx context.Context, req dbplugin.NewUserRequest) (dbplugin.NewUserResponse, error) {
-	if len(req.Statements.Commands) == 0 {
-		return dbplugin.NewUserResponse{}, fmt.Errorf("no creation statements provided")
+	start := time.Now()
+	result, err := c.newUser(ctx, req)
+	c.recordOperation("NewUser", start, err)
+	if err != nil {
+		return dbplugin.NewUserResponse{}, err
 	}
+	return dbplugin.NewUserResponse{Username: result.Username}, nil
+}
 
+// NewUserResult is the outcome of NewUserWithMetadata.
+type NewUserResult struct {
+	Username string
+	// Roles lists the roles granted to the user. It is only filled in when
+	// return_metadata is set.
+	Roles []string
+}
+
+// NewUserWithMetadata is NewUser, also returning the roles granted to the
+// user when return_metadata is set. The dbplugin response has no room for
+// them, so this is only reachable by callers embedding the plugin; NewUser
+// logs them instead.
+func (c *Clickhouse) NewUserWithMetadata(ctx context.Context, req dbplugin.NewUserRequest) (NewUserResult, error) {
+	start := time.Now()
+	result, err := c.newUser(ctx, req)
+	c.recordOperation("NewUser", start, err)
+	return result, err
+}
+
+func (c *Clickhouse) newUser(ctx context.Context, req dbplugin.NewUserRequest) (NewUserResult, error) {
 	c.Lock()
 	defer c.Unlock()
 
+	var (
+		username   string
+		statements []string
+		values     map[string]string
+		err        error
+	)
+	if c.EnsureUniqueUsername {
+		username, statements, values, err = c.uniqueCreationPlan(ctx, req, c.userExists)
+	} else {
+		username, statements, values, err = c.creationPlan(req)
+	}
+	if err != nil {
+		return NewUserResult{}, err
+	}
+
+	c.log().Debug("creating user",
+		"username", username,
+		"role", req.UsernameConfig.RoleName,
+		"statements", len(req.Statements.Commands))
+
+	err = c.executeStatementsWithMap(ctx, statements, c.CreationErrorMode, values)
+	if err != nil {
+		if code, ok := exceptionCode(err); ok && code == codeAccessEntityAlreadyExists {
+			return NewUserResult{}, &UserExistsError{Username: username, Err: err}
+		}
+		return NewUserResult{}, fmt.Errorf("failed to create user: %w", withAccessManagementGuidance(err))
+	}
+
+	result := NewUserResult{Username: username}
+	if c.ReturnMetadata {
+		// The user exists at this point, so a failed lookup must not fail
+		// the creation and leave it behind
+		roles, err := c.grantedRoles(ctx, username)
+		if err != nil {
+			c.log().Warn("failed to look up granted roles", "username", username, "error", err)
+		}
+		result.Roles = roles
+		c.log().Info("created user", "username", username, "roles", roles)
+	}
+
+	return result, nil
+}
+
+// creationPlan generates the username for req and returns it with the
+// creation statements and the values to substitute into them. The caller must
+// hold the lock.
+func (c *Clickhouse) creationPlan(req dbplugin.NewUserRequest) (string, []string, map[string]string, error) {
+	role, err := parseRoleCreation(req.Statements.Commands)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	cfg := role.CreationConfig.withDefaults(c.CreationConfig)
+	if err := cfg.validate(); err != nil {
+		return "", nil, nil, fmt.Errorf("invalid creation settings: %w", err)
+	}
+	if len(role.Statements) == 0 && cfg.isEmpty() {
+		return "", nil, nil, ErrNoCreationStatements
+	}
+
 	username, err := c.usernameProducer.Generate(UsernameMetadata{
 		DisplayName: req.UsernameConfig.DisplayName,
 		RoleName:    req.UsernameConfig.RoleName,
 	})
 	if err != nil {
-		return dbplugin.NewUserResponse{}, fmt.Errorf("failed to generate username: %w", err)
+		return "", nil, nil, fmt.Errorf("failed to generate username: %w", err)
+	}
+	username = applyUsernameCase(c.UsernameCase, c.UsernamePrefix+username+c.UsernameSuffix)
+	if len(username) > maxUsernameLength {
+		return "", nil, nil, fmt.Errorf("generated username %q is longer than %d characters", username, maxUsernameLength)
+	}
+
+	statements := slices.Clone(role.Statements)
+	if len(statements) == 0 {
+		statements = buildCreationStatements(username, cfg, c.AuthType, c.IdentifierQuote)
+	}
+	for _, g := range c.ColumnGrants {
+		grant, err := g.statement()
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("failed to build column grant: %w", err)
+		}
+		statements = append(statements, requoteNames(grant, c.IdentifierQuote))
+	}
+	// A server-side expiration keeps the user from outliving a failed
+	// revocation
+	if c.AutoExpire && !setsValidUntil(statements) {
+		statements = append(statements, requoteNames(autoExpireStatement, c.IdentifierQuote))
+	}
+	if setsValidUntil(statements) && !c.supportsVersion(validUntilVersion) {
+		return "", nil, nil, fmt.Errorf("%w: VALID UNTIL requires ClickHouse %d.%d or later, server is %s",
+			ErrUnsupportedServerVersion, validUntilVersion[0], validUntilVersion[1], c.version)
+	}
+	// An expiration in the past would create a user that is already expired
+	if usesExpiration(statements) && !req.Expiration.After(time.Now()) {
+		return "", nil, nil, fmt.Errorf("%w: %s", ErrExpirationInPast, req.Expiration.Format(time.RFC3339))
 	}
 
-	expirationStr := req.Expiration.Format(time.DateTime)
+	// Users authenticated externally have no password of their own
+	if req.Password == "" && !isExternalAuth(c.AuthType) && usesPassword(statements) {
+		return "", nil, nil, ErrEmptyPassword
+	}
+	if err := checkPasswordQuotes(c.PasswordQuoteMode, req.Password); err != nil {
+		return "", nil, nil, err
+	}
 
-	err = c.executeStatementsWithMap(ctx, req.Statements.Commands, map[string]string{
-		"name":       username,
-		"username":   username,
-		"password":   req.Password,
-		"expiration": expirationStr,
-	})
+	values, err := passwordValues(c.AuthType, req.Password)
 	if err != nil {
-		return dbplugin.NewUserResponse{}, fmt.Errorf("failed to create user: %w", err)
+		return "", nil, nil, err
 	}
+	maps.Copy(values, map[string]string{
+		"ldap_server":      c.LDAPServer,
+		"name":             username,
+		"username":         username,
+		"cluster":          c.Cluster,
+		"password":         req.Password,
+		"expiration":       c.formatExpiration(req.Expiration),
+		"default_database": cmp.Or(role.DefaultDatabase, c.DefaultDatabase),
+		"settings_profile": cmp.Or(role.SettingsProfile, c.SettingsProfile),
+		"user_settings":    role.userSettings(c.UserSettings).clause(),
+		"quota":            cmp.Or(role.Quota, c.Quota),
+		"default_roles":    cfg.defaultRolesClause(),
+	})
 
-	return dbplugin.NewUserResponse{
-		Username: username,
-	}, nil
+	return username, statements, values, nil
 }
 
 // UpdateUser updates an existing user in the ClickHouse database.
 func (c *Clickhouse) UpdateUser(ctx context.Context, req dbplugin.UpdateUserRequest) (dbplugin.UpdateUserResponse, error) {
+	start := time.Now()
+	resp, err := c.updateUser(ctx, req)
+	c.recordOperation("UpdateUser", start, err)
+	return resp, err
+}
+
+func (c *Clickhouse) updateUser(ctx context.Context, req dbplugin.UpdateUserRequest) (dbplugin.UpdateUserResponse, error) {
 	if req.Password == nil && req.Expiration == nil {
-		return dbplugin.UpdateUserResponse{}, fmt.Errorf("no changes requested")
+		return dbplugin.UpdateUserResponse{}, ErrNoChanges
 	}
 
 	c.Lock()
 	defer c.Unlock()
 
+	c.log().Debug("updating user",
+		"username", req.Username,
+		"change_password", req.Password != nil,
+		"change_expiration", req.Expiration != nil)
+
 	if req.Password != nil {
 		err := c.updateUserPassword(ctx, req.Username, req.Password)
 		if err != nil {
 			return dbplugin.UpdateUserResponse{}, err
 		}
+		if c.isRootUser(req.Username) {
+			c.reconnectAsRoot(ctx, req.Password.NewPassword)
+		}
 	}
 
 	if req.Expiration != nil {
@@ -181,16 +419,97 @@ func (c *Clickhouse) UpdateUser(ctx context.Context, req dbplugin.UpdateUserRequ
 }
 
 func (c *Clickhouse) updateUserPassword(ctx context.Context, username string, changePassword *dbplugin.ChangePassword) error {
-	statements := changePassword.Statements.Commands
-	if len(statements) == 0 {
-		statements = []string{defaultRotateCredentialsStatement}
+	if err := checkPasswordQuotes(c.PasswordQuoteMode, changePassword.NewPassword); err != nil {
+		return err
 	}
 
-	return c.executeStatementsWithMap(ctx, statements, map[string]string{
+	statements := c.rotationStatements(changePassword.Statements.Commands)
+
+	// With a grace period the new password is added next to the current
+	// one, which is removed later. Custom rotation statements are run as is.
+	grace := c.RotationGracePeriod > 0 && len(changePassword.Statements.Commands) == 0 &&
+		c.DefaultRotateStatement == "" && !isExternalAuth(c.AuthType)
+	if grace {
+		if !c.supportsVersion(multipleAuthVersion) {
+			return fmt.Errorf("%w: rotation_grace_period requires ClickHouse %d.%d or later, server is %s",
+				ErrUnsupportedServerVersion, multipleAuthVersion[0], multipleAuthVersion[1], c.version)
+		}
+		statements = []string{requoteNames(graceRotationStatement(c.AuthType), c.IdentifierQuote)}
+	}
+
+	values, err := passwordValues(c.AuthType, changePassword.NewPassword)
+	if err != nil {
+		return err
+	}
+	maps.Copy(values, map[string]string{
 		"name":     username,
 		"username": username,
+		"cluster":  c.Cluster,
 		"password": changePassword.NewPassword,
 	})
+
+	// A root rotation must stop at the first failure, so the plugin only
+	// switches to the new password once every statement succeeded
+	errorMode := c.RotationErrorMode
+	if c.isRootUser(username) {
+		errorMode = errorModeStop
+	}
+
+	if err := c.executeStatementsWithMap(ctx, statements, errorMode, values); err != nil {
+		return err
+	}
+	if grace {
+		c.scheduleReset(username)
+	}
+	return nil
+}
+
+// isRootUser reports whether username is the admin user the plugin connects
+// as.
+func (c *Clickhouse) isRootUser(username string) bool {
+	return c.Username != "" && username == c.Username
+}
+
+// reconnectAsRoot reinitializes the connection with the rotated admin
+// password, so new pool connections keep authenticating. The rotated password
+// replaces password_file, which no longer holds it. It does nothing when
+// the connection_url embeds a literal password instead of {{password}}. The
+// rotation already took effect on the server, so a failure is only logged.
+// The caller must hold the lock.
+func (c *Clickhouse) reconnectAsRoot(ctx context.Context, password string) {
+	connURL, _ := c.config["connection_url"].(string)
+	if connURL != "" && !strings.Contains(connURL, "{{password}}") {
+		c.log().Debug("connection_url doesn't use {{password}}, keeping the current connection")
+		return
+	}
+
+	// The rotated password replaces the one read from password_file
+	conf := maps.Clone(c.config)
+	delete(conf, "password_file")
+	conf["password"] = password
+	if err := c.init(ctx, conf, true); err != nil {
+		c.log().Warn("failed to reconnect with the rotated admin password", "error", err)
+	}
+}
+
+// rotationStatements returns the statements changing a password: commands,
+// or the default_rotate_statement when there are none, or else a built-in
+// statement for the configured auth_type. Commands that don't set the
+// password themselves, such as GRANT and REVOKE statements keeping a static
+// role's privileges in sync, run after the default statement.
+func (c *Clickhouse) rotationStatements(commands []string) []string {
+	switch {
+	case len(commands) > 0 && !usesPassword(commands) && !isExternalAuth(c.AuthType):
+		return append(c.rotationStatements(nil), commands...)
+	case len(commands) > 0:
+		return commands
+	case c.DefaultRotateStatement != "":
+		return []string{c.DefaultRotateStatement}
+	case c.AuthType != "":
+		return []string{requoteNames("ALTER USER IF EXISTS '{{name}}' "+identifiedClause(c.AuthType), c.IdentifierQuote)}
+	default:
+		return []string{requoteNames(defaultRotateCredentialsStatement, c.IdentifierQuote)}
+	}
 }
 
 func (c *Clickhouse) updateUserExpiration(ctx context.Context, username string, changeExpiration *dbplugin.ChangeExpiration) error {
@@ -200,72 +519,408 @@ func (c *Clickhouse) updateUserExpiration(ctx context.Context, username string,
 		return nil
 	}
 
-	expirationStr := changeExpiration.NewExpiration.Format(time.DateTime)
+	expirationStr := c.formatExpiration(changeExpiration.NewExpiration)
 
-	return c.executeStatementsWithMap(ctx, statements, map[string]string{
+	return c.executeStatementsWithMap(ctx, statements, errorModeStop, map[string]string{
 		"name":       username,
 		"username":   username,
+		"cluster":    c.Cluster,
 		"expiration": expirationStr,
 	})
 }
 
 // DeleteUser deletes a user from the ClickHouse database.
+//
+// Revocation statements run in the order given, so REVOKE statements should be
+// listed before the drop. Without revocation statements, the configured
+// default_revocation_statement is used. If none of them drops the user, the
+// default DROP USER IF EXISTS statement is appended. The admin user and the
+// protected_users are never deleted.
 func (c *Clickhouse) DeleteUser(ctx context.Context, req dbplugin.DeleteUserRequest) (dbplugin.DeleteUserResponse, error) {
+	start := time.Now()
+	resp, err := c.deleteUser(ctx, req)
+	c.recordOperation("DeleteUser", start, err)
+	return resp, err
+}
+
+func (c *Clickhouse) deleteUser(ctx context.Context, req dbplugin.DeleteUserRequest) (dbplugin.DeleteUserResponse, error) {
 	c.Lock()
 	defer c.Unlock()
 
-	statements := req.Statements.Commands
-	if len(statements) == 0 {
-		statements = []string{defaultRevocationStatement}
+	if c.isProtectedUser(req.Username) {
+		return dbplugin.DeleteUserResponse{}, fmt.Errorf("refusing to delete %q: %w", req.Username, ErrProtectedUser)
 	}
 
-	err := c.executeStatementsWithMap(ctx, statements, map[string]string{
-		"name":     req.Username,
-		"username": req.Username,
-	})
+	var revokeAll []string
+	if c.RevokeAllOnDelete {
+		// Failing to list the roles must not block the deletion; the drop
+		// removes the remaining grants anyway
+		roles, err := c.grantedRoles(ctx, req.Username)
+		if err != nil {
+			c.log().Warn("failed to look up granted roles", "username", req.Username, "error", err)
+		}
+		revokeAll = revokeAllStatements(roles, c.IdentifierQuote)
+	}
+
+	statements := deletionStatements(c.revocationCommands(req.Statements.Commands), revokeAll, c.defaultDropStatement())
+
+	c.log().Debug("deleting user",
+		"username", req.Username,
+		"statements", len(statements))
+
+	db, err := c.connection(ctx)
+	if err == nil {
+		err = c.executeDeletion(ctx, db, req.Username, statements)
+	}
 	if err != nil {
-		return dbplugin.DeleteUserResponse{}, fmt.Errorf("failed to delete user: %w", err)
+		// A user that is already gone is not an error, even if a revocation
+		// statement failed because of it
+		if exists, existsErr := c.userExists(ctx, req.Username); existsErr == nil && !exists {
+			return dbplugin.DeleteUserResponse{}, nil
+		}
+		return dbplugin.DeleteUserResponse{}, fmt.Errorf("failed to delete user: %w", withAccessManagementGuidance(err))
 	}
 
+	c.checkDropPropagated(ctx, req.Username)
+
 	return dbplugin.DeleteUserResponse{}, nil
 }
 
-func (c *Clickhouse) executeStatementsWithMap(ctx context.Context, statements []string, m map[string]string) error {
-	db, err := c.Connection(ctx)
+// checkDropPropagated looks the deleted user up on the read connection, when
+// one is configured, and warns if it is still there: the drop ran locally
+// only, or hasn't replicated yet. The deletion itself succeeded, so this
+// never fails it. The caller must hold the lock.
+func (c *Clickhouse) checkDropPropagated(ctx context.Context, username string) {
+	if c.ReadConnectionURL == "" {
+		return
+	}
+
+	db, err := c.readConnection(ctx)
+	exists := false
+	if err == nil {
+		exists, err = userExistsOn(ctx, db, username)
+	}
+	switch {
+	case err != nil:
+		c.log().Warn("failed to check user removal on the read connection", "username", username, "error", err)
+	case exists:
+		c.log().Warn("deleted user still exists on the read connection; use ON CLUSTER in the revocation statements if the servers don't share their access storage",
+			"username", username, "cluster", c.Cluster)
+	}
+}
+
+func (c *Clickhouse) executeStatementsWithMap(ctx context.Context, statements []string, errorMode string, m map[string]string) error {
+	queries, err := c.renderStatements(statements, m)
+	if err != nil {
+		return err
+	}
+
+	db, err := c.connection(ctx)
 	if err != nil {
 		return err
 	}
 
+	secrets := []string{escapeValue(m["password"], c.IdentifierQuote), m["password"], m["password_hash"]}
+	return c.execQueries(ctx, db, queries, secrets, errorMode == errorModeContinue)
+}
+
+// sqlValues are the values rendered as SQL fragments from validated
+// configuration, with their literals already quoted, so they are substituted
+// without escaping.
+var sqlValues = []string{"user_settings"}
+
+// renderStatements substitutes m into statements and splits the result into
+// individual queries.
+func (c *Clickhouse) renderStatements(statements []string, m map[string]string) ([]string, error) {
+	// Values are substituted inside quoted literals such as '{{password}}', or
+	// quoted identifiers with identifier_quote, so escape them to keep a quote
+	// in a display name or password from ending the literal early
+	escaped := make(map[string]string, len(m))
+	for k, v := range m {
+		if slices.Contains(sqlValues, k) {
+			escaped[k] = v
+			continue
+		}
+		escaped[k] = escapeValue(v, c.IdentifierQuote)
+	}
+
+	var queries []string
 	for _, statement := range statements {
-		parsedStatement := dbutil.QueryHelper(statement, m)
+		parsedStatement := dbutil.QueryHelper(statement, escaped)
 
 		// Split statements by semicolon for multiple statements
-		for _, s := range splitStatements(parsedStatement) {
-			s = strings.TrimSpace(s)
-			if s == "" {
-				continue
-			}
+		split := splitStatements(parsedStatement)
+		if len(split) == 0 && statement != "" && c.StrictStatements {
+			return nil, fmt.Errorf("statement %q contains no executable statements", statement)
+		}
+		queries = append(queries, split...)
+	}
+	return queries, nil
+}
 
-			_, err := db.ExecContext(ctx, s)
-			if err != nil {
-				return fmt.Errorf("failed to execute statement %q: %w", s, err)
-			}
+// executeDeletion runs the revocation statements for username. With
+// kill_sessions_on_delete the user's running queries are killed first.
+func (c *Clickhouse) executeDeletion(ctx context.Context, db execer, username string, statements []string) error {
+	queries, err := c.renderStatements(statements, map[string]string{
+		"name":     username,
+		"username": username,
+		"cluster":  c.Cluster,
+	})
+	if err != nil {
+		return err
+	}
+
+	if c.KillSessionsOnDelete {
+		c.killQueries(ctx, db, username)
+	}
+
+	return c.execQueries(ctx, db, queries, nil, c.RevocationErrorMode == errorModeContinue)
+}
+
+// killQueries kills the running queries of username. Dropping a user doesn't
+// stop queries it already started. This is best effort: a failure, for
+// example on a server where KILL QUERY is not permitted, is only logged.
+func (c *Clickhouse) killQueries(ctx context.Context, db execer, username string) {
+	query := fmt.Sprintf(killQueriesStatement, escapeClickHouseString(username))
+	if err := c.execQuery(ctx, db, query); err != nil {
+		c.log().Warn("failed to kill running queries", "username", username, "error", err)
+	}
+}
+
+// escapeClickHouseString escapes s for use inside a single-quoted ClickHouse
+// string literal.
+func escapeClickHouseString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return strings.ReplaceAll(s, `'`, `\'`)
+}
+
+// execer is the subset of *sql.DB used to run statements.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// execQueries runs the queries in order. By default it stops at the first
+// failure; with continueOnError, failures are logged and the remaining queries
+// still run. Each query is bounded by the configured query timeout, if any.
+// Secrets are masked in the returned error and in the logs.
+func (c *Clickhouse) execQueries(ctx context.Context, db execer, queries, secrets []string, continueOnError bool) error {
+	for i, s := range queries {
+		err := c.execQuery(ctx, db, s)
+		if err == nil {
+			continue
+		}
+
+		stmtErr := &statementError{
+			index:   i + 1,
+			total:   len(queries),
+			query:   s,
+			timeout: c.QueryTimeout,
+			secrets: secrets,
+			err:     err,
+		}
+		if !continueOnError {
+			return stmtErr
 		}
+		c.log().Warn("ignoring failed statement", "error", stmtErr.Error())
 	}
 
 	return nil
 }
 
+// execQuery runs query. Statements failing with a transient error are retried
+// up to statement_retries times, with a backoff doubling after each attempt.
+func (c *Clickhouse) execQuery(ctx context.Context, db execer, query string) error {
+	backoff := c.StatementRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := c.execQueryOnce(ctx, db, query)
+		if err == nil || attempt > c.StatementRetries || !isTransientError(err) {
+			return err
+		}
+
+		// The error may echo the statement, so only its code is logged
+		code, _ := exceptionCode(err)
+		c.log().Warn("retrying statement after transient error", "attempt", attempt, "code", code, "backoff", backoff)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// execQueryOnce runs query once, bounded by the configured query timeout.
+func (c *Clickhouse) execQueryOnce(ctx context.Context, db execer, query string) error {
+	if c.QueryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.QueryTimeout)
+		defer cancel()
+	}
+
+	_, err := db.ExecContext(ctx, query)
+	return err
+}
+
+// statementError reports which statement of a sequence failed. Secrets
+// substituted into the statement are masked in the message, including when
+// the server echoes the statement back in its own error.
+type statementError struct {
+	index   int
+	total   int
+	query   string
+	timeout time.Duration
+	secrets []string
+	err     error
+}
+
+func (e *statementError) Error() string {
+	var msg string
+	if e.timeout > 0 && errors.Is(e.err, context.DeadlineExceeded) {
+		msg = fmt.Sprintf("statement %d of %d timed out after %s: %q: %v", e.index, e.total, e.timeout, e.query, e.err)
+	} else {
+		msg = fmt.Sprintf("statement %d of %d failed: %q: %v", e.index, e.total, e.query, e.err)
+	}
+
+	for _, secret := range e.secrets {
+		if secret == "" {
+			continue
+		}
+		// The query is quoted with %q, which escapes backslashes and double
+		// quotes in the secret
+		quoted := strconv.Quote(secret)
+		msg = strings.ReplaceAll(msg, quoted[1:len(quoted)-1], "[password]")
+		msg = strings.ReplaceAll(msg, secret, "[password]")
+	}
+
+	return msg
+}
+
+func (e *statementError) Unwrap() error {
+	return e.err
+}
+
+// revocationCommands returns commands, or the default_revocation_statement
+// when there are none.
+func (c *Clickhouse) revocationCommands(commands []string) []string {
+	if len(commands) == 0 && c.DefaultRevocationStatement != "" {
+		return []string{c.DefaultRevocationStatement}
+	}
+	return commands
+}
+
+// deletionStatements returns the statements run by DeleteUser: the revokeAll
+// statements, then the revocation statements, then the drop statement if none
+// of them drops the user.
+func deletionStatements(commands, revokeAll []string, drop string) []string {
+	statements := slices.Concat(revokeAll, commands)
+	if !dropsUser(statements) {
+		statements = append(statements, drop)
+	}
+	return statements
+}
+
+// defaultDropStatement returns the statement dropping a user when no
+// revocation statement does. With a cluster configured, the user is dropped
+// ON CLUSTER, as a plain DROP USER only removes it from the local server.
+func (c *Clickhouse) defaultDropStatement() string {
+	statement := defaultRevocationStatement
+	if c.Cluster != "" {
+		statement = clusterRevocationStatement
+	}
+	return requoteNames(statement, c.IdentifierQuote)
+}
+
+// dropsUser reports whether any of the statements is a DROP USER statement.
+func dropsUser(statements []string) bool {
+	for _, statement := range statements {
+		for _, s := range splitStatements(statement) {
+			fields := strings.Fields(strings.ToUpper(s))
+			if len(fields) >= 2 && fields[0] == "DROP" && fields[1] == "USER" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// uniqueCreationPlan is creationPlan, generating the username a second time
+// if exists reports the first one as taken. A second collision is returned as
+// a UserExistsError rather than retried further, as it points at a template
+// without enough randomness.
+func (c *Clickhouse) uniqueCreationPlan(ctx context.Context, req dbplugin.NewUserRequest, exists func(context.Context, string) (bool, error)) (string, []string, map[string]string, error) {
+	for attempt := 0; ; attempt++ {
+		username, statements, values, err := c.creationPlan(req)
+		if err != nil {
+			return "", nil, nil, err
+		}
+
+		taken, err := exists(ctx, username)
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("failed to check username uniqueness: %w", err)
+		}
+		if !taken {
+			return username, statements, values, nil
+		}
+		if attempt > 0 {
+			return "", nil, nil, &UserExistsError{Username: username, Err: fmt.Errorf("generated username is already taken")}
+		}
+		c.log().Debug("generated username is already taken, generating a new one", "username", username)
+	}
+}
+
+// usesPassword reports whether any of statements references the password,
+// directly or through its hash.
+func usesPassword(statements []string) bool {
+	for _, statement := range statements {
+		if strings.Contains(statement, "{{password}}") || strings.Contains(statement, "{{password_hash}}") {
+			return true
+		}
+	}
+	return false
+}
+
+// usesExpiration reports whether any of statements references the
+// {{expiration}} placeholder.
+func usesExpiration(statements []string) bool {
+	for _, statement := range statements {
+		if strings.Contains(statement, "{{expiration}}") {
+			return true
+		}
+	}
+	return false
+}
+
+// setsValidUntil reports whether any of statements sets a VALID UNTIL clause.
+func setsValidUntil(statements []string) bool {
+	for _, statement := range statements {
+		for _, s := range splitStatements(statement) {
+			if strings.Contains(strings.Join(strings.Fields(strings.ToUpper(s)), " "), "VALID UNTIL") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func splitStatements(s string) []string {
-	// Simple split by semicolon, but handle quoted strings
+	// Simple split by semicolon, but handle quoted strings and backtick-quoted
+	// identifiers, including backslash-escaped quotes inside them
 	var statements []string
 	var current strings.Builder
 	inQuote := false
+	escaped := false
 	quoteChar := rune(0)
 
 	for _, char := range s {
 		switch {
-		case char == '\'' || char == '"':
+		case escaped:
+			escaped = false
+			current.WriteRune(char)
+		case char == '\\' && inQuote:
+			escaped = true
+			current.WriteRune(char)
+		case char == '\'' || char == '"' || char == '`':
 			if !inQuote {
 				inQuote = true
 				quoteChar = char
@@ -293,12 +948,6 @@ func splitStatements(s string) []string {
 	return statements
 }
 
-func (c *Clickhouse) secretValues() map[string]string {
-	return map[string]string{
-		c.Password: "[password]",
-	}
-}
-
 // Lock locks the connection producer mutex.
 func (c *Clickhouse) Lock() {
 	c.clickhouseConnectionProducer.Lock()
@@ -5,12 +5,19 @@
 package main
 
 import (
+	"os"
+	// Embedded so expiration_timezone works on hosts without a zoneinfo database
+	_ "time/tzdata"
+
 	clickhouse "github.com/elaunira/openbao-plugin-database-clickhouse"
+	"github.com/hashicorp/go-hclog"
 	"github.com/openbao/openbao/sdk/v2/database/dbplugin/v5"
 )
 
 var (
 	version = "dev"
+	commit  = ""
+	date    = ""
 )
 
 func main() {
@@ -19,7 +26,19 @@ func main() {
 
 // Run instantiates a clickhouse object and runs the RPC server for the plugin.
 func Run() {
-	f := clickhouse.New(clickhouse.DefaultUserNameTemplate(), version)
+	// OpenBao reads the plugin's JSON log lines from stderr
+	logger := hclog.New(&hclog.LoggerOptions{
+		Name:       "clickhouse",
+		Level:      hclog.Info,
+		Output:     os.Stderr,
+		JSONFormat: true,
+	})
+
+	f := clickhouse.NewWithLogger(clickhouse.DefaultUserNameTemplate(), clickhouse.BuildInfo{
+		Version: version,
+		Commit:  commit,
+		Date:    date,
+	}, logger)
 
 	dbplugin.ServeMultiplex(f)
 }
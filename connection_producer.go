@@ -5,47 +5,247 @@ package clickhouse
 
 import (
 	"context"
+	"crypto/tls"
 	"database/sql"
+	"errors"
 	"fmt"
+	"maps"
+	"net"
 	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	_ "github.com/ClickHouse/clickhouse-go/v2" // ClickHouse driver
+	ch "github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-secure-stdlib/parseutil"
 	"github.com/mitchellh/mapstructure"
 )
 
 // clickhouseConnectionProducer implements the database.ConnectionProducer interface.
 type clickhouseConnectionProducer struct {
-	ConnectionURL          string `json:"connection_url" mapstructure:"connection_url"`
-	Host                   string `json:"host" mapstructure:"host"`
-	Port                   int    `json:"port" mapstructure:"port"`
-	Username               string `json:"username" mapstructure:"username"`
-	Password               string `json:"password" mapstructure:"password"`
-	Database               string `json:"database" mapstructure:"database"`
-	TLS                    bool   `json:"tls" mapstructure:"tls"`
-	TLSSkipVerify          bool   `json:"tls_skip_verify" mapstructure:"tls_skip_verify"`
-	MaxOpenConnections     int    `json:"max_open_connections" mapstructure:"max_open_connections"`
-	MaxIdleConnections     int    `json:"max_idle_connections" mapstructure:"max_idle_connections"`
-	MaxConnectionLifetimeS int    `json:"max_connection_lifetime" mapstructure:"max_connection_lifetime"`
-	Debug                  bool   `json:"debug" mapstructure:"debug"`
+	ConnectionURL         string            `json:"connection_url" mapstructure:"connection_url"`
+	ReadConnectionURL     string            `json:"read_connection_url" mapstructure:"read_connection_url"`
+	Host                  string            `json:"host" mapstructure:"host"`
+	Hosts                 []string          `json:"hosts" mapstructure:"hosts"`
+	AltHosts              []string          `json:"alt_hosts" mapstructure:"alt_hosts"`
+	Port                  int               `json:"port" mapstructure:"port"`
+	Socket                string            `json:"socket" mapstructure:"socket"`
+	Username              string            `json:"username" mapstructure:"username"`
+	Password              string            `json:"password" mapstructure:"password"`
+	PasswordFile          string            `json:"password_file" mapstructure:"password_file"`
+	Database              string            `json:"database" mapstructure:"database"`
+	TLS                   bool              `json:"tls" mapstructure:"tls"`
+	TLSSkipVerify         bool              `json:"tls_skip_verify" mapstructure:"tls_skip_verify"`
+	TLSServerName         string            `json:"tls_server_name" mapstructure:"tls_server_name"`
+	TLSCAPath             string            `json:"tls_ca_path" mapstructure:"tls_ca_path"`
+	TLSCA                 string            `json:"tls_ca" mapstructure:"tls_ca"`
+	TLSClientCert         string            `json:"tls_client_cert" mapstructure:"tls_client_cert"`
+	TLSClientKey          string            `json:"tls_client_key" mapstructure:"tls_client_key"`
+	RequireTLS            bool              `json:"require_tls" mapstructure:"require_tls"`
+	MaxOpenConnections    int               `json:"max_open_connections" mapstructure:"max_open_connections"`
+	MaxIdleConnections    int               `json:"max_idle_connections" mapstructure:"max_idle_connections"`
+	MaxConnectionLifetime time.Duration     `json:"max_connection_lifetime" mapstructure:"max_connection_lifetime"`
+	MaxConnectionIdleTime time.Duration     `json:"max_connection_idle_time" mapstructure:"max_connection_idle_time"`
+	SkipConnectionPing    bool              `json:"skip_connection_ping" mapstructure:"skip_connection_ping"`
+	WarmConnections       int               `json:"warm_connections" mapstructure:"warm_connections"`
+	KeepAliveInterval     time.Duration     `json:"keep_alive_interval" mapstructure:"keep_alive_interval"`
+	Debug                 bool              `json:"debug" mapstructure:"debug"`
+	Protocol              string            `json:"protocol" mapstructure:"protocol"`
+	DialTimeout           time.Duration     `json:"dial_timeout" mapstructure:"dial_timeout"`
+	Compression           string            `json:"compression" mapstructure:"compression"`
+	CompressionLevel      int               `json:"compression_level" mapstructure:"compression_level"`
+	ConnectRetries        int               `json:"connect_retries" mapstructure:"connect_retries"`
+	ConnectRetryInterval  time.Duration     `json:"connect_retry_interval" mapstructure:"connect_retry_interval"`
+	NativeProbe           string            `json:"native_probe" mapstructure:"native_probe"`
+	HTTPProbe             string            `json:"http_probe" mapstructure:"http_probe"`
+	StatementRetries      int               `json:"statement_retries" mapstructure:"statement_retries"`
+	StatementRetryBackoff time.Duration     `json:"statement_retry_backoff" mapstructure:"statement_retry_backoff"`
+	MaxReplicationLag     time.Duration     `json:"max_replication_lag" mapstructure:"max_replication_lag"`
+	RotationGracePeriod   time.Duration     `json:"rotation_grace_period" mapstructure:"rotation_grace_period"`
+	QueryTimeout          time.Duration     `json:"query_timeout" mapstructure:"query_timeout"`
+	StrictStatements      bool              `json:"strict_statements" mapstructure:"strict_statements"`
+	StrictConfig          bool              `json:"strict_config" mapstructure:"strict_config"`
+	DefaultDatabase       string            `json:"default_database" mapstructure:"default_database"`
+	SettingsProfile       string            `json:"settings_profile" mapstructure:"settings_profile"`
+	UserSettings          userSettings      `json:"user_settings" mapstructure:"user_settings"`
+	UsernamePrefix        string            `json:"username_prefix" mapstructure:"username_prefix"`
+	UsernameSuffix        string            `json:"username_suffix" mapstructure:"username_suffix"`
+	UsernameCase          string            `json:"username_case" mapstructure:"username_case"`
+	IdentifierQuote       string            `json:"identifier_quote" mapstructure:"identifier_quote"`
+	AuthType              string            `json:"auth_type" mapstructure:"auth_type"`
+	LDAPServer            string            `json:"ldap_server" mapstructure:"ldap_server"`
+	Cluster               string            `json:"cluster" mapstructure:"cluster"`
+	Quota                 string            `json:"quota" mapstructure:"quota"`
+	ColumnGrants          []columnGrant     `json:"column_grants" mapstructure:"column_grants"`
+	CreationConfig        CreationConfig    `json:"creation_config" mapstructure:"creation_config"`
+	RevokeAllOnDelete     bool              `json:"revoke_all_on_delete" mapstructure:"revoke_all_on_delete"`
+	ProtectedUsers        []string          `json:"protected_users" mapstructure:"protected_users"`
+	MaskUsername          bool              `json:"mask_username" mapstructure:"mask_username"`
+	KillSessionsOnDelete  bool              `json:"kill_sessions_on_delete" mapstructure:"kill_sessions_on_delete"`
+	EnsureUniqueUsername  bool              `json:"ensure_unique_username" mapstructure:"ensure_unique_username"`
+	ReturnMetadata        bool              `json:"return_metadata" mapstructure:"return_metadata"`
+	AutoExpire            bool              `json:"auto_expire" mapstructure:"auto_expire"`
+	CreationErrorMode     string            `json:"creation_error_mode" mapstructure:"creation_error_mode"`
+	PasswordQuoteMode     string            `json:"password_quote_mode" mapstructure:"password_quote_mode"`
+	RevocationErrorMode   string            `json:"revocation_error_mode" mapstructure:"revocation_error_mode"`
+	RotationErrorMode     string            `json:"rotation_error_mode" mapstructure:"rotation_error_mode"`
+	ConnectionSettings    map[string]string `json:"connection_settings" mapstructure:"connection_settings"`
+	ConnectionParams      map[string]string `json:"connection_params" mapstructure:"connection_params"`
+	HTTPHeaders           map[string]string `json:"http_headers" mapstructure:"http_headers"`
+	ClientName            string            `json:"client_name" mapstructure:"client_name"`
+	ExpirationFormat      string            `json:"expiration_format" mapstructure:"expiration_format"`
+	ExpirationTimezone    string            `json:"expiration_timezone" mapstructure:"expiration_timezone"`
+
+	// DefaultRotateStatement and DefaultRevocationStatement replace the
+	// built-in statements used when a role doesn't set its own, and
+	// DisableStatement the one used by RevokeUser.
+	DefaultRotateStatement     string `json:"default_rotate_statement" mapstructure:"default_rotate_statement"`
+	DefaultRevocationStatement string `json:"default_revocation_statement" mapstructure:"default_revocation_statement"`
+	DisableStatement           string `json:"disable_statement" mapstructure:"disable_statement"`
+
+	// GeneratedPasswordPolicy shapes the passwords the plugin generates. The
+	// password_policy key is reserved by the database secrets engine, which
+	// removes it before the plugin sees the configuration.
+	GeneratedPasswordPolicy passwordPolicy `json:"generated_password_policy" mapstructure:"generated_password_policy"`
+
+	// clientVersion is reported to the server along with ClientName.
+	clientVersion string
+	// version is the server version detected when the connection was last
+	// verified, or empty if unknown.
+	version string
+	// config is the configuration last accepted by Init, kept to reconnect
+	// after the admin password was rotated.
+	config map[string]interface{}
 
 	initialized bool
 	db          *sql.DB
+	readDB      *sql.DB
+	// expirationLocation is the parsed expiration_timezone, or nil to keep
+	// the location of the requested expiration.
+	expirationLocation *time.Location
+	logger             hclog.Logger
+	// stopKeepAlive and keepAliveDone control the keep-alive goroutine
+	// started by Init when keep_alive_interval is set.
+	stopKeepAlive context.CancelFunc
+	keepAliveDone chan struct{}
+	// pendingResets holds the rotations in their grace period, by username.
+	pendingResets map[string]*pendingReset
+	// timerFunc schedules the end of a grace period. It is a seam for tests
+	// and defaults to time.AfterFunc.
+	timerFunc func(d time.Duration, f func()) func() bool
+	// ping checks the liveness of the cached pool. It is a seam for tests and
+	// defaults to (*sql.DB).PingContext.
+	ping func(ctx context.Context, db *sql.DB) error
 	sync.Mutex
 }
 
+const (
+	// probePing selects the driver ping as the connection probe.
+	probePing = "ping"
+
+	// defaultHTTPProbe is used over HTTP, where a ping does not fully
+	// exercise authentication.
+	defaultHTTPProbe = "SELECT 1"
+
+	defaultConnectRetryInterval = time.Second
+
+	// defaultClientName identifies the plugin in system.query_log.
+	defaultClientName = "openbao-clickhouse-plugin"
+
+	// defaultStatementRetryBackoff is the delay before the first retry of a
+	// statement; it doubles with each further attempt.
+	defaultStatementRetryBackoff = 500 * time.Millisecond
+)
+
+// Statement error modes. With errorModeStop an operation fails at the first
+// failing statement; with errorModeContinue failures are logged and the
+// remaining statements still run.
+const (
+	errorModeStop     = "stop_on_error"
+	errorModeContinue = "continue_on_error"
+)
+
+// stalePingBackoff is the delay before re-pinging a cached pool whose first
+// ping failed, so a momentary network blip doesn't tear down a healthy pool.
+const stalePingBackoff = 200 * time.Millisecond
+
 // Init initializes the connection producer with the provided configuration.
+// Options missing from conf take their defaults, whatever a previous Init set.
 func (c *clickhouseConnectionProducer) Init(ctx context.Context, conf map[string]interface{}, verifyConnection bool) error {
 	c.Lock()
 	defer c.Unlock()
 
-	if err := mapstructure.WeakDecode(conf, c); err != nil {
+	return c.init(ctx, conf, verifyConnection)
+}
+
+// Reload applies a changed configuration, for example after the admin
+// password was rotated outside of OpenBao. It merges conf over the
+// configuration last accepted by Init, closes the current pool and verifies
+// the new connection. Keys missing from conf keep their current values.
+func (c *clickhouseConnectionProducer) Reload(ctx context.Context, conf map[string]interface{}) error {
+	c.Lock()
+	defer c.Unlock()
+
+	merged := make(map[string]interface{}, len(c.config)+len(conf))
+	maps.Copy(merged, c.config)
+	// password and password_file are exclusive, so setting one replaces the
+	// other
+	if _, ok := conf["password"]; ok {
+		delete(merged, "password_file")
+	}
+	if _, ok := conf["password_file"]; ok {
+		delete(merged, "password")
+	}
+	maps.Copy(merged, conf)
+
+	return c.init(ctx, merged, true)
+}
+
+// init implements Init and Reload. The caller must hold the lock.
+func (c *clickhouseConnectionProducer) init(ctx context.Context, conf map[string]interface{}, verifyConnection bool) error {
+	// A pool opened for the previous configuration must not be reused
+	if err := c.closeConnections(); err != nil {
+		c.log().Warn("failed to close previous connection pool", "error", err)
+	}
+
+	// Every Init starts from a blank configuration, so options left out of
+	// conf, a connection URL built from the previous one or a password read
+	// from a since rotated password_file don't carry over
+	c.resetConfig()
+	c.version = ""
+
+	// Unknown keys are rejected so that typos don't silently leave a default
+	// in effect
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook:       durationSecondHook,
+		WeaklyTypedInput: true,
+		ErrorUnused:      true,
+		Result:           c,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create configuration decoder: %w", err)
+	}
+	if err := decoder.Decode(producerConfig(conf)); err != nil {
 		return fmt.Errorf("failed to decode configuration: %w", err)
 	}
 
+	if _, ok := conf["password"]; ok && c.PasswordFile != "" {
+		return fmt.Errorf("password and password_file are mutually exclusive")
+	}
+	if c.PasswordFile != "" {
+		password, err := os.ReadFile(c.PasswordFile)
+		if err != nil {
+			return fmt.Errorf("failed to read password_file: %w", err)
+		}
+		c.Password = strings.TrimSpace(string(password))
+	}
+
 	// Set defaults
 	if c.MaxOpenConnections == 0 {
 		c.MaxOpenConnections = 4
@@ -53,20 +253,213 @@ func (c *clickhouseConnectionProducer) Init(ctx context.Context, conf map[string
 	if c.MaxIdleConnections == 0 {
 		c.MaxIdleConnections = c.MaxOpenConnections
 	}
-	if c.MaxConnectionLifetimeS == 0 {
-		c.MaxConnectionLifetimeS = 0 // No limit
+	if c.MaxConnectionLifetime == 0 {
+		c.MaxConnectionLifetime = 0 // No limit
+	}
+	if c.ClientName == "" {
+		c.ClientName = defaultClientName
+	}
+	if strings.ContainsAny(c.ClientName, " \t\n/,") {
+		return fmt.Errorf("client_name %q must not contain whitespace, slashes or commas", c.ClientName)
+	}
+	if c.NativeProbe == "" {
+		c.NativeProbe = probePing
+	}
+	if c.HTTPProbe == "" {
+		c.HTTPProbe = defaultHTTPProbe
+	}
+
+	for field, mode := range map[string]*string{
+		"creation_error_mode":   &c.CreationErrorMode,
+		"revocation_error_mode": &c.RevocationErrorMode,
+		"rotation_error_mode":   &c.RotationErrorMode,
+	} {
+		if *mode == "" {
+			*mode = errorModeStop
+		}
+		if *mode != errorModeStop && *mode != errorModeContinue {
+			return fmt.Errorf("invalid %s %q: must be %q or %q", field, *mode, errorModeStop, errorModeContinue)
+		}
+	}
+
+	if c.PasswordQuoteMode == "" {
+		c.PasswordQuoteMode = passwordQuoteEscape
+	}
+	if c.PasswordQuoteMode != passwordQuoteEscape && c.PasswordQuoteMode != passwordQuoteReject {
+		return fmt.Errorf("invalid password_quote_mode %q: must be %q or %q", c.PasswordQuoteMode, passwordQuoteEscape, passwordQuoteReject)
+	}
+
+	if c.ConnectRetries < 0 {
+		return fmt.Errorf("connect_retries must not be negative")
+	}
+	if c.WarmConnections < 0 {
+		return fmt.Errorf("warm_connections must not be negative")
+	}
+	if c.KeepAliveInterval < 0 {
+		return fmt.Errorf("keep_alive_interval must not be negative")
+	}
+	if c.ConnectRetryInterval < 0 {
+		return fmt.Errorf("connect_retry_interval must not be negative")
+	}
+	if c.ConnectRetryInterval == 0 {
+		c.ConnectRetryInterval = defaultConnectRetryInterval
+	}
+
+	if c.StatementRetries < 0 {
+		return fmt.Errorf("statement_retries must not be negative")
+	}
+	if c.StatementRetryBackoff < 0 {
+		return fmt.Errorf("statement_retry_backoff must not be negative")
+	}
+	if c.MaxReplicationLag < 0 {
+		return fmt.Errorf("max_replication_lag must not be negative")
+	}
+	if c.RotationGracePeriod < 0 {
+		return fmt.Errorf("rotation_grace_period must not be negative")
+	}
+	if c.StatementRetryBackoff == 0 {
+		c.StatementRetryBackoff = defaultStatementRetryBackoff
+	}
+
+	if c.QueryTimeout < 0 {
+		return fmt.Errorf("query_timeout must not be negative")
+	}
+
+	if c.ExpirationFormat == "" {
+		c.ExpirationFormat = time.DateTime
+	}
+	c.expirationLocation = nil
+	if c.ExpirationTimezone != "" {
+		loc, err := time.LoadLocation(c.ExpirationTimezone)
+		if err != nil {
+			return fmt.Errorf("invalid expiration_timezone: %w", err)
+		}
+		c.expirationLocation = loc
+	}
+
+	for field, affix := range map[string]string{
+		"username_prefix": c.UsernamePrefix,
+		"username_suffix": c.UsernameSuffix,
+	} {
+		if err := validateUsernameChars(affix); err != nil {
+			return fmt.Errorf("invalid %s: %w", field, err)
+		}
+	}
+	if len(c.UsernamePrefix)+len(c.UsernameSuffix) >= maxUsernameLength {
+		return fmt.Errorf("username_prefix and username_suffix leave no room for the generated username (limit %d characters)", maxUsernameLength)
+	}
+
+	if c.UsernameCase == "" {
+		c.UsernameCase = usernameCasePreserve
+	}
+	if err := validateUsernameCase(c.UsernameCase); err != nil {
+		return err
+	}
+
+	if c.IdentifierQuote == "" {
+		c.IdentifierQuote = identifierQuoteSingle
+	}
+	if err := validateIdentifierQuote(c.IdentifierQuote); err != nil {
+		return err
+	}
+
+	if err := validateAuthType(c.AuthType); err != nil {
+		return err
+	}
+	if c.AuthType == authLDAP && c.LDAPServer == "" {
+		return fmt.Errorf("ldap_server is required when auth_type is %q", authLDAP)
+	}
+
+	for field, statement := range map[string]string{
+		"default_rotate_statement":     c.DefaultRotateStatement,
+		"default_revocation_statement": c.DefaultRevocationStatement,
+		"disable_statement":            c.DisableStatement,
+	} {
+		if statement != "" && !strings.Contains(statement, "{{name}}") && !strings.Contains(statement, "{{username}}") {
+			return fmt.Errorf("%s must reference {{name}}", field)
+		}
+	}
+
+	if c.GeneratedPasswordPolicy.Length < 0 {
+		return fmt.Errorf("generated_password_policy length must not be negative")
+	}
+
+	if err := validateIdentifier("default_database", c.DefaultDatabase); err != nil {
+		return err
+	}
+
+	if err := c.UserSettings.validate(); err != nil {
+		return fmt.Errorf("invalid user_settings: %w", err)
+	}
+	if err := validateIdentifier("settings_profile", c.SettingsProfile); err != nil {
+		return err
+	}
+
+	if err := validateIdentifier("quota", c.Quota); err != nil {
+		return err
+	}
+
+	for _, g := range c.ColumnGrants {
+		if _, err := g.statement(); err != nil {
+			return fmt.Errorf("invalid column_grants: %w", err)
+		}
+	}
+
+	if err := c.CreationConfig.validate(); err != nil {
+		return fmt.Errorf("invalid creation_config: %w", err)
+	}
+
+	if err := checkExtraParams(c.ConnectionSettings); err != nil {
+		return fmt.Errorf("invalid connection_settings: %w", err)
+	}
+
+	if err := checkExtraParams(c.ConnectionParams); err != nil {
+		return fmt.Errorf("invalid connection_params: %w", err)
+	}
+
+	for name, value := range c.HTTPHeaders {
+		if !httpHeaderNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid http_headers name %q", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("http_headers value for %q must not contain line breaks", name)
+		}
+	}
+
+	if err := validateCompression(c.Compression, c.CompressionLevel); err != nil {
+		return fmt.Errorf("invalid compression configuration: %w", err)
+	}
+
+	if c.DialTimeout < 0 {
+		return fmt.Errorf("dial_timeout must not be negative")
+	}
+
+	// connection_url takes precedence over the discrete connection fields
+	if overridden := c.overriddenFields(); c.ConnectionURL != "" && len(overridden) > 0 {
+		if c.StrictConfig {
+			return fmt.Errorf("connection_url cannot be combined with %s", strings.Join(overridden, ", "))
+		}
+		c.log().Warn("connection_url is set, ignoring discrete connection fields", "fields", overridden)
 	}
 
 	// Build connection URL if not provided
 	if c.ConnectionURL == "" {
 		builder := newConnStringBuilder().
 			WithHost(c.Host).
+			WithHosts(splitList(c.Hosts)).
+			WithAltHosts(splitList(c.AltHosts)).
 			WithPort(c.Port).
+			WithSocket(c.Socket).
 			WithDatabase(c.Database).
 			WithUsername(c.Username).
 			WithPassword(c.Password).
 			WithTLS(c.TLS, c.TLSSkipVerify).
-			WithDebug(c.Debug)
+			WithDebug(c.Debug).
+			WithProtocol(c.Protocol).
+			WithDialTimeout(c.DialTimeout).
+			WithCompression(c.Compression, c.CompressionLevel)
+		builder.WithExtraParams(c.ConnectionSettings)
+		builder.WithExtraParams(c.ConnectionParams)
 
 		if err := builder.Check(); err != nil {
 			return fmt.Errorf("invalid connection configuration: %w", err)
@@ -74,87 +467,821 @@ func (c *clickhouseConnectionProducer) Init(ctx context.Context, conf map[string
 
 		c.ConnectionURL = builder.BuildConnectionString()
 	} else {
-		// Substitute {{username}} and {{password}} placeholders in connection URL
-		// URL-encode the values to handle special characters
-		c.ConnectionURL = strings.ReplaceAll(c.ConnectionURL, "{{username}}", url.PathEscape(c.Username))
-		c.ConnectionURL = strings.ReplaceAll(c.ConnectionURL, "{{password}}", url.PathEscape(c.Password))
+		connURL, err := c.expandConnectionURL(c.ConnectionURL)
+		if err != nil {
+			return fmt.Errorf("invalid connection_url: %w", err)
+		}
+		c.ConnectionURL = connURL
+	}
+
+	opts, err := c.clientOptions()
+	if err != nil {
+		return fmt.Errorf("invalid connection configuration: %w", err)
+	}
+	if c.RequireTLS && !negotiatesTLS(c.ConnectionURL, opts) {
+		if c.Socket != "" {
+			return fmt.Errorf("require_tls is set but connections through socket don't use TLS: set tls")
+		}
+		return fmt.Errorf("require_tls is set but the connection doesn't use TLS: set tls, or secure=true in connection_url")
+	}
+
+	if len(c.HTTPHeaders) > 0 && protocolFromURL(c.ConnectionURL) != protocolHTTP {
+		return fmt.Errorf("http_headers requires the http protocol")
+	}
+
+	if c.ReadConnectionURL != "" {
+		readURL, err := c.expandConnectionURL(c.ReadConnectionURL)
+		if err != nil {
+			return fmt.Errorf("invalid read_connection_url: %w", err)
+		}
+		readOpts, err := c.clientOptionsFor(readURL)
+		if err != nil {
+			return fmt.Errorf("invalid read_connection_url: %w", err)
+		}
+		if c.RequireTLS && !negotiatesTLS(readURL, readOpts) {
+			return fmt.Errorf("require_tls is set but read_connection_url doesn't use TLS")
+		}
+		c.ReadConnectionURL = readURL
 	}
 
+	// The pools need the producer marked initialized, so it is reset below if
+	// verification fails
 	c.initialized = true
 
+	c.log().Debug("initialized connection producer",
+		"protocol", protocolFromURL(c.ConnectionURL),
+		"verify_connection", verifyConnection)
+
 	if verifyConnection {
-		db, err := c.Connection(ctx)
+		if err := c.verifyConnections(ctx); err != nil {
+			// Don't keep a pool for a configuration that failed to verify, so a
+			// retry with corrected settings starts clean
+			_ = c.closeConnections()
+			return err
+		}
+	}
+
+	c.config = maps.Clone(conf)
+
+	if c.KeepAliveInterval > 0 {
+		c.startKeepAlive(c.KeepAliveInterval)
+	}
+
+	return nil
+}
+
+// verifyConnections checks that the primary and read pools can reach the
+// server, then checks the cluster, detects the server version and warms the
+// primary pool. The caller must hold the lock and closes the pools on error.
+func (c *clickhouseConnectionProducer) verifyConnections(ctx context.Context) error {
+	db, err := c.connection(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to verify connection: %w", mapAuthenticationError(err))
+	}
+	if err := c.verify(ctx, db, c.ConnectRetryInterval); err != nil {
+		return fmt.Errorf("failed to ping database: %w", mapAuthenticationError(err))
+	}
+
+	if c.ReadConnectionURL != "" {
+		readDB, err := c.readConnection(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to verify read connection: %w", mapAuthenticationError(err))
+		}
+		if err := c.verify(ctx, readDB, c.ConnectRetryInterval); err != nil {
+			return fmt.Errorf("failed to ping read database: %w", mapAuthenticationError(err))
+		}
+	}
+
+	if c.Cluster != "" {
+		if err := c.checkCluster(ctx, db); err != nil {
+			if c.StrictConfig {
+				return err
+			}
+			c.log().Warn("cluster check failed", "cluster", c.Cluster, "error", err)
+		}
+	}
+
+	version, err := serverVersion(ctx, db)
+	if err != nil {
+		c.log().Warn("failed to detect server version", "error", err)
+	}
+	c.version = version
+
+	// The connection is verified, so a failed warm-up only costs the
+	// latency it was meant to save
+	if err := warm(ctx, db, c.warmConnectionCount()); err != nil {
+		c.log().Warn("failed to warm connection pool", "error", err)
+	}
+
+	return nil
+}
+
+// expandConnectionURL substitutes the {{username}}, {{password}} and
+// {{database}} placeholders in connURL, URL-encoding the values to handle
+// special characters, and adds the configured defaults.
+func (c *clickhouseConnectionProducer) expandConnectionURL(connURL string) (string, error) {
+	connURL = strings.ReplaceAll(connURL, "{{username}}", url.PathEscape(c.Username))
+	connURL = strings.ReplaceAll(connURL, "{{password}}", url.PathEscape(c.Password))
+	connURL = strings.ReplaceAll(connURL, "{{database}}", url.PathEscape(c.Database))
+
+	if err := validateConnectionURL(connURL); err != nil {
+		return "", err
+	}
+
+	// The driver only sets up TLS when secure is given, even for https
+	defaults := c.urlDefaults()
+	if strings.HasPrefix(connURL, "https://") {
+		defaults.Set("secure", trueVal)
+	}
+
+	return mergeURLDefaults(connURL, defaults)
+}
+
+// checkCluster confirms that the configured cluster is listed in
+// system.clusters, so a typo is caught before the first statement using
+// {{cluster}} fails.
+func (c *clickhouseConnectionProducer) checkCluster(ctx context.Context, db *sql.DB) error {
+	var count uint64
+	err := db.QueryRowContext(ctx, "SELECT count() FROM system.clusters WHERE cluster = ?", c.Cluster).Scan(&count)
+	if err != nil {
+		return fmt.Errorf("failed to look up cluster %q: %w", c.Cluster, err)
+	}
+	if count == 0 {
+		return fmt.Errorf("cluster %q is not defined in system.clusters", c.Cluster)
+	}
+	return nil
+}
+
+// warmConnectionCount returns warm_connections bounded by the pool limits, as
+// connections beyond them would be closed straight away.
+func (c *clickhouseConnectionProducer) warmConnectionCount() int {
+	n := c.WarmConnections
+	if c.MaxOpenConnections > 0 {
+		n = min(n, c.MaxOpenConnections)
+	}
+	if c.MaxIdleConnections > 0 {
+		n = min(n, c.MaxIdleConnections)
+	}
+	return n
+}
+
+// warm opens and pings n connections at once, then returns them to the pool
+// as idle connections.
+func warm(ctx context.Context, db *sql.DB, n int) error {
+	conns := make([]*sql.Conn, 0, n)
+	defer func() {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}()
+
+	for range n {
+		conn, err := db.Conn(ctx)
 		if err != nil {
-			return fmt.Errorf("failed to verify connection: %w", err)
+			return err
 		}
-		if err := db.PingContext(ctx); err != nil {
-			return fmt.Errorf("failed to ping database: %w", err)
+		conns = append(conns, conn)
+		if err := conn.PingContext(ctx); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-// Connection returns a database connection.
+// overriddenFields returns the names of the configured connection fields that
+// are ignored when connection_url is set. The username, password and database
+// are not included, as they fill the connection_url placeholders.
+func (c *clickhouseConnectionProducer) overriddenFields() []string {
+	var fields []string
+	if c.Host != "" {
+		fields = append(fields, "host")
+	}
+	if len(c.Hosts) > 0 {
+		fields = append(fields, "hosts")
+	}
+	if len(c.AltHosts) > 0 {
+		fields = append(fields, "alt_hosts")
+	}
+	if c.Port != 0 {
+		fields = append(fields, "port")
+	}
+	if c.TLS {
+		fields = append(fields, "tls")
+	}
+	if c.TLSSkipVerify {
+		fields = append(fields, "tls_skip_verify")
+	}
+	if c.Protocol != "" {
+		fields = append(fields, "protocol")
+	}
+	if c.Debug {
+		fields = append(fields, "debug")
+	}
+	return fields
+}
+
+// resetConfig zeroes the configuration fields, the ones decoded from the
+// mapstructure tags, leaving the runtime state such as the pools, pending
+// grace periods and logger alone. The caller must hold the lock.
+func (c *clickhouseConnectionProducer) resetConfig() {
+	v := reflect.ValueOf(c).Elem()
+	for i := range v.NumField() {
+		if v.Type().Field(i).Tag.Get("mapstructure") != "" {
+			v.Field(i).SetZero()
+		}
+	}
+}
+
+// nonProducerConfigKeys are configuration keys handled outside the
+// connection producer.
+var nonProducerConfigKeys = []string{"username_template"}
+
+// producerConfig returns conf without the keys handled outside the connection
+// producer.
+func producerConfig(conf map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(conf))
+	for k, v := range conf {
+		if !slices.Contains(nonProducerConfigKeys, k) {
+			result[k] = v
+		}
+	}
+	return result
+}
+
+// durationSecondHook decodes time.Duration fields from either an integer
+// number of seconds or a duration string such as "30m".
+func durationSecondHook(_ reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+	if to != reflect.TypeOf(time.Duration(0)) {
+		return data, nil
+	}
+	return parseutil.ParseDurationSecond(data)
+}
+
+// Initialized reports whether Init succeeded and the producer has not been
+// closed since.
+func (c *clickhouseConnectionProducer) Initialized() bool {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.initialized
+}
+
+// Connection returns a database connection. It is safe for concurrent use,
+// but must not be called while holding the lock; code that already holds it
+// uses connection instead.
 func (c *clickhouseConnectionProducer) Connection(ctx context.Context) (*sql.DB, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.connection(ctx)
+}
+
+// connection returns the cached pool, opening a new one if there is none or
+// the cached one is stale. The caller must hold the lock.
+func (c *clickhouseConnectionProducer) connection(ctx context.Context) (*sql.DB, error) {
+	return c.pool(ctx, &c.db, c.ConnectionURL, !c.SkipConnectionPing)
+}
+
+// readConnection returns the pool for read-only queries: the
+// read_connection_url pool when one is configured, the primary pool
+// otherwise. The caller must hold the lock.
+func (c *clickhouseConnectionProducer) readConnection(ctx context.Context) (*sql.DB, error) {
+	if c.ReadConnectionURL == "" {
+		return c.connection(ctx)
+	}
+	return c.pool(ctx, &c.readDB, c.ReadConnectionURL, !c.SkipConnectionPing)
+}
+
+// pool returns the pool cached in *cached, replacing it with a new pool for
+// connURL if there is none or the cached one is stale. The cached pool is only
+// pinged when check is set; otherwise it is trusted as is.
+func (c *clickhouseConnectionProducer) pool(ctx context.Context, cached **sql.DB, connURL string, check bool) (*sql.DB, error) {
 	if !c.initialized {
-		return nil, fmt.Errorf("connection producer not initialized")
+		return nil, ErrNotInitialized
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
-	if c.db != nil {
-		if err := c.db.PingContext(ctx); err == nil {
-			return c.db, nil
+	if *cached != nil {
+		if !check || c.isAlive(ctx, *cached) {
+			return *cached, nil
+		}
+		// A ping cut short by the caller says nothing about the pool
+		if err := ctx.Err(); err != nil {
+			return nil, err
 		}
 		// Connection is stale, close it
-		_ = c.db.Close()
-		c.db = nil
+		_ = (*cached).Close()
+		*cached = nil
 	}
 
-	db, err := sql.Open("clickhouse", c.ConnectionURL)
+	opts, err := c.clientOptionsFor(connURL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database connection: %w", err)
 	}
 
+	// OpenDB applies the driver's own pool defaults, so ours must come after.
+	db := ch.OpenDB(opts)
 	db.SetMaxOpenConns(c.MaxOpenConnections)
 	db.SetMaxIdleConns(c.MaxIdleConnections)
-	if c.MaxConnectionLifetimeS > 0 {
-		db.SetConnMaxLifetime(time.Duration(c.MaxConnectionLifetimeS) * time.Second)
-	}
+	db.SetConnMaxLifetime(c.MaxConnectionLifetime)
+	db.SetConnMaxIdleTime(c.MaxConnectionIdleTime)
 
-	c.db = db
+	*cached = db
 	return db, nil
 }
 
-// Close closes the database connection.
+// clientOptions parses the connection URL into driver options and applies
+// the TLS settings that cannot be expressed in the DSN.
+func (c *clickhouseConnectionProducer) clientOptions() (*ch.Options, error) {
+	return c.clientOptionsFor(c.ConnectionURL)
+}
+
+// clientOptionsFor is clientOptions for the given connection URL.
+func (c *clickhouseConnectionProducer) clientOptionsFor(connURL string) (*ch.Options, error) {
+	opts, err := ch.ParseDSN(connURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.configureTLS(opts); err != nil {
+		return nil, err
+	}
+
+	// The address in the URL is still used for the HTTP Host header and TLS
+	// server name, but every connection goes through the socket
+	if c.Socket != "" {
+		opts.DialContext = socketDialer(c.Socket, opts)
+	}
+
+	if len(c.HTTPHeaders) > 0 {
+		if opts.HttpHeaders == nil {
+			opts.HttpHeaders = make(map[string]string, len(c.HTTPHeaders))
+		}
+		maps.Copy(opts.HttpHeaders, c.HTTPHeaders)
+	}
+
+	// A client_info_product given in the connection URL takes precedence
+	if len(opts.ClientInfo.Products) == 0 && c.ClientName != "" {
+		opts.ClientInfo.Products = append(opts.ClientInfo.Products, struct{ Name, Version string }{
+			Name:    c.ClientName,
+			Version: c.clientVersion,
+		})
+	}
+
+	return opts, nil
+}
+
+// negotiatesTLS reports whether connections made to connURL with opts use
+// TLS, through a socket or not. Over the native protocol the driver, or
+// socketDialer, wraps connections in TLS when opts.TLS is set; over HTTP the
+// transport does so when the URL scheme is https.
+func negotiatesTLS(connURL string, opts *ch.Options) bool {
+	if opts.Protocol == ch.HTTP {
+		u, err := url.Parse(connURL)
+		return err == nil && u.Scheme == "https"
+	}
+	return opts.TLS != nil
+}
+
+// socketDialer returns a DialContext connecting to the Unix socket instead of
+// the given address, within opts.DialTimeout. The HTTP transport adds TLS on
+// top of the dialed connection, but the native protocol leaves it to the
+// dialer, so native connections are wrapped in TLS here when it is enabled.
+func socketDialer(socket string, opts *ch.Options) func(ctx context.Context, addr string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: opts.DialTimeout}
+	tlsConfig := opts.TLS
+	if opts.Protocol == ch.HTTP {
+		tlsConfig = nil
+	}
+
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, "unix", socket)
+		if err != nil || tlsConfig == nil {
+			return conn, err
+		}
+
+		// As with a TCP connection, the server name defaults to the host of
+		// the address
+		config := tlsConfig
+		if config.ServerName == "" {
+			config = tlsConfig.Clone()
+			if host, _, err := net.SplitHostPort(addr); err == nil {
+				config.ServerName = host
+			} else {
+				config.ServerName = addr
+			}
+		}
+
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
+
+// isAlive pings the cached pool, retrying once after a short backoff before
+// reporting it as stale.
+func (c *clickhouseConnectionProducer) isAlive(ctx context.Context, db *sql.DB) bool {
+	ping := c.pingFunc()
+
+	if err := ping(ctx, db); err == nil {
+		return true
+	}
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(stalePingBackoff):
+	}
+
+	return ping(ctx, db) == nil
+}
+
+// verify pings the database, retrying up to ConnectRetries times with the
+// given interval so a server that is still starting has time to come up.
+func (c *clickhouseConnectionProducer) verify(ctx context.Context, db *sql.DB, interval time.Duration) error {
+	ping := c.pingFunc()
+
+	var err error
+	for attempt := 0; attempt <= c.ConnectRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(interval):
+			}
+		}
+
+		if err = ping(ctx, db); err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// pingFunc returns the function used to check the liveness of a pool. It
+// returns as soon as ctx is done, even if the underlying check doesn't.
+func (c *clickhouseConnectionProducer) pingFunc() func(ctx context.Context, db *sql.DB) error {
+	ping := c.probe
+	if c.ping != nil {
+		ping = c.ping
+	}
+	return func(ctx context.Context, db *sql.DB) error {
+		return pingContext(ctx, ping, db)
+	}
+}
+
+// pingContext runs ping in the background and waits for it or for ctx,
+// whichever finishes first. A ping abandoned this way completes on its own.
+func pingContext(ctx context.Context, ping func(context.Context, *sql.DB) error, db *sql.DB) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- ping(ctx, db)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// probe checks that the pool is usable, either with a driver ping or by
+// running the probe query configured for the connection protocol.
+func (c *clickhouseConnectionProducer) probe(ctx context.Context, db *sql.DB) error {
+	query := c.probeQuery()
+	if query == "" || strings.EqualFold(query, probePing) {
+		return db.PingContext(ctx)
+	}
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rows.Close() }()
+
+	return rows.Err()
+}
+
+// probeQuery returns the probe configured for the protocol used by the
+// connection URL.
+func (c *clickhouseConnectionProducer) probeQuery() string {
+	if protocolFromURL(c.ConnectionURL) == protocolHTTP {
+		return c.HTTPProbe
+	}
+	return c.NativeProbe
+}
+
+// protocolFromURL returns the protocol implied by the connection URL scheme.
+func protocolFromURL(connURL string) string {
+	u, err := url.Parse(connURL)
+	if err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		return protocolHTTP
+	}
+	return protocolNative
+}
+
+// formatExpiration renders t for the {{expiration}} placeholder using
+// expiration_format and expiration_timezone.
+func (c *clickhouseConnectionProducer) formatExpiration(t time.Time) string {
+	if c.expirationLocation != nil {
+		t = t.In(c.expirationLocation)
+	}
+	layout := c.ExpirationFormat
+	if layout == "" {
+		layout = time.DateTime
+	}
+	return t.Format(layout)
+}
+
+// log returns the configured logger, or a logger discarding all output.
+func (c *clickhouseConnectionProducer) log() hclog.Logger {
+	if c.logger == nil {
+		return hclog.NewNullLogger()
+	}
+	return c.logger
+}
+
+// Close ends any rotation grace period early, stops the keep-alive and closes
+// the database connections. It is meant for the plugin shutting down.
 func (c *clickhouseConnectionProducer) Close() error {
-	if c.db != nil {
-		err := c.db.Close()
-		c.db = nil
+	c.flushPendingResets()
+	return c.closeConnections()
+}
+
+// closeConnections stops the keep-alive and closes the database connections.
+// Unlike Close, it leaves pending grace periods running, so re-initializing
+// doesn't cut them short.
+func (c *clickhouseConnectionProducer) closeConnections() error {
+	c.stopKeepAliveLoop()
+	c.initialized = false
+
+	var errs []error
+	for _, db := range []**sql.DB{&c.db, &c.readDB} {
+		if *db != nil {
+			errs = append(errs, (*db).Close())
+			*db = nil
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SecretValues maps the sensitive configuration values to the placeholders
+// masking them: the admin password, the admin username when mask_username is
+// set, and an inline tls_client_key. The password and username are mapped in
+// every form they take in a connection URL or a statement. It backs both the
+// error sanitizer middleware and DebugConnectionString.
+func (c *clickhouseConnectionProducer) SecretValues() map[string]string {
+	secrets := make(map[string]string)
+	add := func(secret, placeholder string) {
+		if secret == "" {
+			return
+		}
+		for _, form := range secretForms(secret, c.IdentifierQuote) {
+			secrets[form] = placeholder
+		}
+	}
+
+	add(c.Password, "[password]")
+	if c.MaskUsername {
+		add(c.Username, "[username]")
+	}
+	if isInlinePEM(c.TLSClientKey) {
+		secrets[c.TLSClientKey] = "[tls_client_key]"
+	}
+	return secrets
+}
+
+// secretForms returns the forms a secret can take: its query, path and
+// userinfo escapings in a connection URL, its escaping in a statement quoted
+// in the given identifier_quote style, and the raw value.
+func secretForms(secret, quoteStyle string) []string {
+	userinfo := strings.TrimPrefix(url.UserPassword("", secret).String(), ":")
+	return []string{url.QueryEscape(secret), url.PathEscape(secret), userinfo, escapeValue(secret, quoteStyle), secret}
+}
+
+// maskSecrets replaces the secrets in s with their placeholders. Longer
+// secrets are replaced first, so an escaped form is never left partially
+// masked by the replacement of a shorter form it contains.
+func maskSecrets(s string, secrets map[string]string) string {
+	keys := slices.Collect(maps.Keys(secrets))
+	slices.SortFunc(keys, func(a, b string) int { return len(b) - len(a) })
+	for _, secret := range keys {
+		if secret == "" {
+			continue
+		}
+		s = strings.ReplaceAll(s, secret, secrets[secret])
+	}
+	return s
+}
+
+// DebugConnectionString returns the effective connection URL with the values
+// of SecretValues masked.
+func (c *clickhouseConnectionProducer) DebugConnectionString() string {
+	return maskSecrets(c.ConnectionURL, c.SecretValues())
+}
+
+const compressionNone = "none"
+
+// compressionLevelRanges holds the supported compression algorithms and the
+// accepted compression_level bounds for each of them.
+var compressionLevelRanges = map[string][2]int{
+	compressionNone: {0, 0},
+	"lz4":           {1, 12},
+	"zstd":          {1, 22},
+}
+
+// validateCompression checks that the compression algorithm is supported and
+// that the compression level is within its valid range. A zero level leaves
+// the driver default.
+func validateCompression(method string, level int) error {
+	if _, ok := compressionLevelRanges[method]; method != "" && !ok {
+		return fmt.Errorf("unsupported compression %q (must be one of none, lz4, zstd)", method)
+	}
+	if level == 0 {
+		return nil
+	}
+	if method == "" {
+		return fmt.Errorf("compression_level requires compression to be set")
+	}
+
+	bounds := compressionLevelRanges[method]
+	if method == compressionNone {
+		return fmt.Errorf("compression_level is not supported for compression %q", method)
+	}
+	if level < bounds[0] || level > bounds[1] {
+		return fmt.Errorf("compression_level %d is out of range for %s (%d-%d)", level, method, bounds[0], bounds[1])
+	}
+
+	return nil
+}
+
+// httpHeaderNamePattern matches valid HTTP header field names (RFC 9110
+// tokens).
+var httpHeaderNamePattern = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// supportedSchemes lists the connection_url schemes understood by the
+// clickhouse-go driver.
+var supportedSchemes = []string{"clickhouse", "tcp", "http", "https"}
+
+// validateConnectionURL checks that the connection URL parses and uses a
+// scheme supported by the driver. The URL itself is kept out of the returned
+// error since it may embed credentials.
+func validateConnectionURL(connURL string) error {
+	u, err := url.Parse(connURL)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return fmt.Errorf("failed to parse URL: %w", urlErr.Err)
+		}
+		return fmt.Errorf("failed to parse URL")
+	}
+
+	if !slices.Contains(supportedSchemes, u.Scheme) {
+		return fmt.Errorf("unsupported scheme %q (must be one of %s)", u.Scheme, strings.Join(supportedSchemes, ", "))
+	}
+	if u.Host == "" {
+		return fmt.Errorf("host is required")
+	}
+
+	q := u.Query()
+	secure, err := queryBool(q, "secure")
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "https" && q.Has("secure") && !secure {
+		return fmt.Errorf("the https scheme requires TLS but secure is false")
+	}
+	if _, err := queryBool(q, "skip_verify"); err != nil {
 		return err
 	}
+
 	return nil
 }
 
-// SecretValues returns sensitive values for masking in logs.
-func (c *clickhouseConnectionProducer) SecretValues() map[string]string {
-	return map[string]string{
-		c.Password: "[password]",
+// queryBool parses the boolean query parameter key the way the driver does:
+// a parameter given without a value is true, and one that is missing false.
+func queryBool(q url.Values, key string) (bool, error) {
+	if !q.Has(key) {
+		return false, nil
+	}
+	v := q.Get(key)
+	if v == "" {
+		return true, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %q is not a boolean", key, v)
+	}
+	return b, nil
+}
+
+// urlDefaults returns the configured parameters that are added to a user
+// supplied connection_url when it doesn't already set them.
+func (c *clickhouseConnectionProducer) urlDefaults() url.Values {
+	defaults := make(url.Values)
+	if c.Compression != "" && c.Compression != compressionNone {
+		defaults.Set("compress", c.Compression)
+	}
+	if c.CompressionLevel != 0 {
+		defaults.Set("compress_level", strconv.Itoa(c.CompressionLevel))
+	}
+	if c.DialTimeout > 0 {
+		defaults.Set("dial_timeout", c.DialTimeout.String())
+	}
+	for k, v := range c.ConnectionSettings {
+		defaults.Set(k, v)
+	}
+	for k, v := range c.ConnectionParams {
+		defaults.Set(k, v)
+	}
+	return defaults
+}
+
+// mergeURLDefaults appends the default query parameters missing from the
+// connection URL. The rest of the URL, including parameters already present,
+// is kept exactly as written.
+func mergeURLDefaults(connURL string, defaults url.Values) (string, error) {
+	if len(defaults) == 0 {
+		return connURL, nil
+	}
+
+	u, err := url.Parse(connURL)
+	if err != nil {
+		return "", err
+	}
+
+	q := u.Query()
+	missing := make(url.Values)
+	for k, v := range defaults {
+		if !q.Has(k) {
+			missing[k] = v
+		}
+	}
+	if len(missing) == 0 {
+		return connURL, nil
+	}
+
+	base, fragment, hasFragment := strings.Cut(connURL, "#")
+	switch {
+	case !strings.Contains(base, "?"):
+		base += "?"
+	case !strings.HasSuffix(base, "?") && !strings.HasSuffix(base, "&"):
+		base += "&"
 	}
+
+	result := base + missing.Encode()
+	if hasFragment {
+		result += "#" + fragment
+	}
+
+	return result, nil
 }
 
-const trueVal = "true"
+const (
+	trueVal = "true"
+
+	protocolNative = "native"
+	protocolHTTP   = "http"
+)
+
+// connOpenInOrder is the connection_open_strategy trying the hosts in the
+// order they are listed.
+const connOpenInOrder = "in_order"
 
 // ConnStringBuilder is a builder for ClickHouse connection strings.
 type ConnStringBuilder struct {
-	host          string
-	port          int
-	database      string
-	username      string
-	password      string
-	tls           bool
-	tlsSkipVerify bool
-	debug         bool
-	extraParams   map[string]string
+	scheme           string
+	host             string
+	hosts            []string
+	altHosts         []string
+	port             int
+	socket           string
+	database         string
+	username         string
+	password         string
+	tls              bool
+	tlsSkipVerify    bool
+	debug            bool
+	protocol         string
+	dialTimeout      time.Duration
+	compression      string
+	compressionLevel int
+	extraParams      map[string]string
+
+	// err records the first invalid option so it can be reported by Check.
+	err error
 }
 
 // newConnStringBuilder creates a new connection string builder.
@@ -173,9 +1300,15 @@ func NewConnStringBuilderFromConnString(connString string) (*ConnStringBuilder,
 		return nil, fmt.Errorf("failed to parse connection string: %w", err)
 	}
 
-	builder.host = u.Hostname()
+	builder.WithScheme(u.Scheme)
+
+	if strings.Contains(u.Host, ",") {
+		builder.hosts = splitList([]string{u.Host})
+	} else {
+		builder.host = u.Hostname()
+	}
 
-	if portStr := u.Port(); portStr != "" {
+	if portStr := u.Port(); portStr != "" && len(builder.hosts) == 0 {
 		port, err := strconv.Atoi(portStr)
 		if err != nil {
 			return nil, fmt.Errorf("invalid port: %w", err)
@@ -202,34 +1335,99 @@ func NewConnStringBuilderFromConnString(connString string) (*ConnStringBuilder,
 		builder.password = q.Get("password")
 	}
 
+	// The http and https schemes imply the HTTP protocol, and https implies
+	// TLS unless the secure parameter says otherwise
+	if u.Scheme == "http" || u.Scheme == "https" {
+		builder.protocol = protocolHTTP
+	}
+	builder.tls = u.Scheme == "https"
+
 	// Parse TLS settings
-	if q.Get("secure") == trueVal {
-		builder.tls = true
+	if q.Has("secure") {
+		if builder.tls, err = queryBool(q, "secure"); err != nil {
+			return nil, err
+		}
 	}
-	if q.Get("skip_verify") == trueVal {
-		builder.tlsSkipVerify = true
+	if builder.tlsSkipVerify, err = queryBool(q, "skip_verify"); err != nil {
+		return nil, err
 	}
 
 	// Parse debug
-	if q.Get("debug") == trueVal {
-		builder.debug = true
+	if builder.debug, err = queryBool(q, "debug"); err != nil {
+		return nil, err
+	}
+
+	if timeoutStr := q.Get("dial_timeout"); timeoutStr != "" {
+		timeout, err := time.ParseDuration(timeoutStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dial_timeout: %w", err)
+		}
+		builder.dialTimeout = timeout
+	}
+
+	// Parse compression
+	builder.compression = q.Get("compress")
+	if levelStr := q.Get("compress_level"); levelStr != "" {
+		level, err := strconv.Atoi(levelStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid compress_level: %w", err)
+		}
+		builder.compressionLevel = level
 	}
 
 	return builder, nil
 }
 
+// WithScheme sets the URL scheme emitted by BuildConnectionString. An empty
+// scheme derives it from the protocol and TLS settings, defaulting to
+// clickhouse.
+func (b *ConnStringBuilder) WithScheme(scheme string) *ConnStringBuilder {
+	if scheme != "" && !slices.Contains(supportedSchemes, scheme) {
+		b.setErr(fmt.Errorf("unsupported scheme %q (must be one of %s)", scheme, strings.Join(supportedSchemes, ", ")))
+	}
+	b.scheme = scheme
+	return b
+}
+
 // WithHost sets the host.
 func (b *ConnStringBuilder) WithHost(host string) *ConnStringBuilder {
 	b.host = host
 	return b
 }
 
+// WithHosts sets a list of hosts used for failover. Entries without an
+// explicit port use the builder port. When set, hosts takes precedence over
+// the single host.
+func (b *ConnStringBuilder) WithHosts(hosts []string) *ConnStringBuilder {
+	b.hosts = hosts
+	return b
+}
+
+// WithAltHosts sets secondary hosts, tried only once the primary host or
+// hosts failed. Entries without an explicit port use the builder port.
+//
+// clickhouse-go v2 has no alt_hosts parameter and forwards unknown URL
+// parameters to the server as settings, which rejects alt_hosts. The alt hosts
+// are therefore appended to the host list, which the driver tries in order.
+// Check fails when connection_open_strategy is set to anything else.
+func (b *ConnStringBuilder) WithAltHosts(hosts []string) *ConnStringBuilder {
+	b.altHosts = hosts
+	return b
+}
+
 // WithPort sets the port.
 func (b *ConnStringBuilder) WithPort(port int) *ConnStringBuilder {
 	b.port = port
 	return b
 }
 
+// WithSocket sets the path of a Unix domain socket to connect through. The
+// host and port become optional, as they are not used to dial.
+func (b *ConnStringBuilder) WithSocket(socket string) *ConnStringBuilder {
+	b.socket = socket
+	return b
+}
+
 // WithDatabase sets the database name.
 func (b *ConnStringBuilder) WithDatabase(database string) *ConnStringBuilder {
 	b.database = database
@@ -261,23 +1459,259 @@ func (b *ConnStringBuilder) WithDebug(debug bool) *ConnStringBuilder {
 	return b
 }
 
+// WithCompression sets the wire compression algorithm and level. An empty
+// method or "none" disables compression; a zero level keeps the driver default.
+func (b *ConnStringBuilder) WithCompression(method string, level int) *ConnStringBuilder {
+	if err := validateCompression(method, level); err != nil {
+		b.setErr(err)
+	}
+	b.compression = method
+	b.compressionLevel = level
+	return b
+}
+
+// WithProtocol sets the protocol, either "native" or "http". An empty value
+// selects the native protocol.
+func (b *ConnStringBuilder) WithProtocol(protocol string) *ConnStringBuilder {
+	if protocol != "" && protocol != protocolNative && protocol != protocolHTTP {
+		b.setErr(fmt.Errorf("unsupported protocol %q (must be native or http)", protocol))
+	}
+	b.protocol = protocol
+	return b
+}
+
+// WithDialTimeout sets the dial timeout. A zero value keeps the driver default.
+func (b *ConnStringBuilder) WithDialTimeout(timeout time.Duration) *ConnStringBuilder {
+	if timeout < 0 {
+		b.setErr(fmt.Errorf("dial timeout must not be negative"))
+	}
+	b.dialTimeout = timeout
+	return b
+}
+
+func (b *ConnStringBuilder) setErr(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
 // WithExtraParam adds an extra query parameter.
 func (b *ConnStringBuilder) WithExtraParam(key, value string) *ConnStringBuilder {
 	b.extraParams[key] = value
 	return b
 }
 
+// WithExtraParams adds extra query parameters, replacing earlier values of the
+// same keys. Keys must not be empty or one of the managedParams.
+func (b *ConnStringBuilder) WithExtraParams(params map[string]string) *ConnStringBuilder {
+	if err := checkExtraParams(params); err != nil {
+		b.setErr(err)
+		return b
+	}
+	for k, v := range params {
+		b.WithExtraParam(k, v)
+	}
+	return b
+}
+
+// managedParams are the query parameters set from dedicated fields, which
+// extra parameters must not override.
+var managedParams = []string{"username", "password", "secure", "skip_verify"}
+
+// checkExtraParams returns an error if params has an empty key or sets one of
+// the managedParams.
+func checkExtraParams(params map[string]string) error {
+	for k := range params {
+		if strings.TrimSpace(k) == "" {
+			return fmt.Errorf("parameter names must not be empty")
+		}
+		if slices.Contains(managedParams, k) {
+			return fmt.Errorf("parameter %q is managed by the plugin and cannot be set directly", k)
+		}
+	}
+	return nil
+}
+
 // Check validates the connection string builder configuration.
 func (b *ConnStringBuilder) Check() error {
+	if b.err != nil {
+		return b.err
+	}
+
+	if b.port != 0 {
+		if err := checkPort(b.port); err != nil {
+			return err
+		}
+	}
+
+	if len(b.altHosts) > 0 {
+		if b.socket != "" {
+			return fmt.Errorf("socket cannot be combined with alt_hosts")
+		}
+		if strategy, ok := b.extraParams["connection_open_strategy"]; ok && strategy != connOpenInOrder {
+			return fmt.Errorf("alt_hosts requires connection_open_strategy %q, not %q", connOpenInOrder, strategy)
+		}
+		if err := b.checkHostList("alt_hosts", b.altHosts); err != nil {
+			return err
+		}
+	}
+
+	if len(b.hosts) > 0 {
+		if b.socket != "" {
+			return fmt.Errorf("socket cannot be combined with hosts")
+		}
+		return b.checkHostList("hosts", b.hosts)
+	}
+
+	if b.socket != "" {
+		return checkHost(b.host)
+	}
+
 	if b.host == "" {
 		return fmt.Errorf("host is required")
 	}
+	if err := checkHost(b.host); err != nil {
+		return err
+	}
 	if b.port == 0 {
 		return fmt.Errorf("port is required")
 	}
 	return nil
 }
 
+// checkHostList validates the entries of a host list. Entries without a port
+// require the builder port.
+func (b *ConnStringBuilder) checkHostList(field string, hosts []string) error {
+	for _, h := range hosts {
+		if h == "" {
+			return fmt.Errorf("%s must not contain empty entries", field)
+		}
+		if err := checkHost(h); err != nil {
+			return err
+		}
+		if !hasPort(h) {
+			if b.port == 0 {
+				return fmt.Errorf("port is required for host %q", h)
+			}
+			continue
+		}
+		_, p, _ := net.SplitHostPort(h)
+		port, err := strconv.Atoi(p)
+		if err != nil {
+			return fmt.Errorf("invalid port in host %q", h)
+		}
+		if err := checkPort(port); err != nil {
+			return fmt.Errorf("host %q: %w", h, err)
+		}
+	}
+	return nil
+}
+
+// checkHost rejects hosts given as URLs, such as "http://host", which would
+// otherwise produce an invalid DSN.
+func checkHost(host string) error {
+	if strings.Contains(host, "://") {
+		return fmt.Errorf("host %q must not include a scheme; use the protocol and tls options instead", host)
+	}
+	return nil
+}
+
+// checkPort rejects ports outside the valid TCP range.
+func checkPort(port int) error {
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("port %d is out of range (1-65535)", port)
+	}
+	return nil
+}
+
+// address returns the host portion of the connection string. Multiple hosts
+// are joined with commas as expected by clickhouse-go, followed by the alt
+// hosts. A socket without a host uses localhost.
+func (b *ConnStringBuilder) address() string {
+	var addrs []string
+	switch {
+	case len(b.hosts) > 0:
+		addrs = b.joinHostList(b.hosts)
+	case b.socket != "" && b.host == "":
+		// The driver requires an address, even one it doesn't dial
+		addrs = []string{joinHostPort("localhost", b.port)}
+	default:
+		addrs = []string{joinHostPort(b.host, b.port)}
+	}
+
+	return strings.Join(append(addrs, b.joinHostList(b.altHosts)...), ",")
+}
+
+// joinHostList returns the addresses of hosts, adding the builder port to
+// entries without one.
+func (b *ConnStringBuilder) joinHostList(hosts []string) []string {
+	addrs := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		if hasPort(h) {
+			addrs = append(addrs, h)
+		} else {
+			addrs = append(addrs, joinHostPort(h, b.port))
+		}
+	}
+	return addrs
+}
+
+// joinHostPort combines a host and port, bracketing IPv6 literals. Hosts that
+// are already bracketed are accepted as well. A zero port is left out, as in
+// a connection string parsed without one.
+func joinHostPort(host string, port int) string {
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if port == 0 {
+		if strings.Contains(host, ":") {
+			return "[" + host + "]"
+		}
+		return host
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// hasPort reports whether the host string carries an explicit port.
+func hasPort(host string) bool {
+	_, _, err := net.SplitHostPort(host)
+	return err == nil
+}
+
+// splitList flattens a list, such as hosts, whose entries may themselves be
+// comma-separated, trimming whitespace and dropping empty entries.
+func splitList(entries []string) []string {
+	var result []string
+	for _, entry := range entries {
+		for _, item := range strings.Split(entry, ",") {
+			item = strings.TrimSpace(item)
+			if item != "" {
+				result = append(result, item)
+			}
+		}
+	}
+	return result
+}
+
+// urlScheme returns the configured scheme, or the one implied by the protocol
+// and TLS settings.
+func (b *ConnStringBuilder) urlScheme() string {
+	switch {
+	case b.scheme == "http" && b.tls:
+		// The driver rejects http with TLS and https without it
+		return "https"
+	case b.scheme == "https" && !b.tls:
+		return "http"
+	case b.scheme != "":
+		return b.scheme
+	}
+	if b.protocol == protocolHTTP {
+		if b.tls {
+			return "https"
+		}
+		return "http"
+	}
+	return "clickhouse"
+}
+
 // BuildConnectionString builds a ClickHouse connection string.
 func (b *ConnStringBuilder) BuildConnectionString() string {
 	q := make(url.Values)
@@ -297,14 +1731,29 @@ func (b *ConnStringBuilder) BuildConnectionString() string {
 	if b.debug {
 		q.Set("debug", trueVal)
 	}
+	if b.compression != "" && b.compression != compressionNone {
+		q.Set("compress", b.compression)
+		if b.compressionLevel != 0 {
+			q.Set("compress_level", strconv.Itoa(b.compressionLevel))
+		}
+	}
+	if b.dialTimeout > 0 {
+		q.Set("dial_timeout", b.dialTimeout.String())
+	}
+
+	// The alt hosts must only be tried after the primary ones. A strategy set
+	// by the caller is kept; Check rejects any other than in_order.
+	if _, ok := b.extraParams["connection_open_strategy"]; len(b.altHosts) > 0 && !ok {
+		q.Set("connection_open_strategy", connOpenInOrder)
+	}
 
 	for k, v := range b.extraParams {
 		q.Set(k, v)
 	}
 
 	u := &url.URL{
-		Scheme:   "clickhouse",
-		Host:     fmt.Sprintf("%s:%d", b.host, b.port),
+		Scheme:   b.urlScheme(),
+		Host:     b.address(),
 		Path:     b.database,
 		RawQuery: q.Encode(),
 	}
@@ -0,0 +1,302 @@
+// Copyright (c) 2024 Elaunira
+// SPDX-License-Identifier: MPL-2.0
+
+package clickhouse
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/openbao/openbao/sdk/v2/database/dbplugin/v5"
+)
+
+// CreationConfig describes a user in structured form so the plugin can
+// generate the creation statements instead of requiring hand-written SQL.
+type CreationConfig struct {
+	Roles []string `json:"roles" mapstructure:"roles"`
+	// RolesAdminOption grants the roles WITH ADMIN OPTION, so the user can
+	// grant them to others.
+	RolesAdminOption bool `json:"roles_admin_option" mapstructure:"roles_admin_option"`
+	// DefaultRoles are the granted roles active when the user logs in. By
+	// default all granted roles are.
+	DefaultRoles    []string        `json:"default_roles" mapstructure:"default_roles"`
+	Grants          []CreationGrant `json:"grants" mapstructure:"grants"`
+	SettingsProfile string          `json:"settings_profile" mapstructure:"settings_profile"`
+	// Settings are pinned on the user along with the settings profile.
+	Settings userSettings `json:"settings" mapstructure:"settings"`
+}
+
+// CreationGrant is a privilege, or a list of privileges granted in one
+// statement, on a database, or on a single table when Table is set.
+// GrantOption grants them WITH GRANT OPTION.
+type CreationGrant struct {
+	Privilege   string   `json:"privilege" mapstructure:"privilege"`
+	Privileges  []string `json:"privileges" mapstructure:"privileges"`
+	Database    string   `json:"database" mapstructure:"database"`
+	Table       string   `json:"table" mapstructure:"table"`
+	GrantOption bool     `json:"grant_option" mapstructure:"grant_option"`
+}
+
+// isEmpty reports whether no structured creation settings are configured.
+func (cfg CreationConfig) isEmpty() bool {
+	return len(cfg.Roles) == 0 && len(cfg.Grants) == 0 && cfg.SettingsProfile == "" && len(cfg.Settings) == 0
+}
+
+// validate checks the configuration so buildCreationStatements can assume
+// well-formed input.
+func (cfg CreationConfig) validate() error {
+	for _, role := range cfg.Roles {
+		if role == "" {
+			return fmt.Errorf("role names must not be empty")
+		}
+	}
+	if cfg.RolesAdminOption && len(cfg.Roles) == 0 {
+		return fmt.Errorf("roles_admin_option requires roles")
+	}
+	for _, role := range cfg.DefaultRoles {
+		if !safeIdentifierPattern.MatchString(role) {
+			return fmt.Errorf("default role %q is not a valid identifier", role)
+		}
+		if !slices.Contains(cfg.Roles, role) {
+			return fmt.Errorf("default role %q is not one of the granted roles", role)
+		}
+	}
+
+	if err := cfg.Settings.validate(); err != nil {
+		return err
+	}
+
+	for _, g := range cfg.Grants {
+		if g.Privilege != "" && len(g.Privileges) > 0 {
+			return fmt.Errorf("privilege and privileges are mutually exclusive")
+		}
+		privileges := g.privileges()
+		if len(privileges) == 0 {
+			return fmt.Errorf("a privilege is required for grants")
+		}
+		for _, privilege := range privileges {
+			if !privilegePattern.MatchString(privilege) {
+				return fmt.Errorf("invalid privilege %q", privilege)
+			}
+		}
+		if g.Database == "" {
+			return fmt.Errorf("database is required for grants")
+		}
+		if strings.IndexFunc(g.Database, unicode.IsControl) >= 0 {
+			return fmt.Errorf("database %q contains a control character", g.Database)
+		}
+	}
+
+	return nil
+}
+
+// withDefaults returns cfg with the fields it leaves empty taken from def.
+// roles_admin_option follows the roles it applies to.
+func (cfg CreationConfig) withDefaults(def CreationConfig) CreationConfig {
+	if len(cfg.Roles) == 0 {
+		cfg.Roles = def.Roles
+		cfg.RolesAdminOption = def.RolesAdminOption
+	}
+	if len(cfg.DefaultRoles) == 0 {
+		cfg.DefaultRoles = def.DefaultRoles
+	}
+	if len(cfg.Grants) == 0 {
+		cfg.Grants = def.Grants
+	}
+	if cfg.SettingsProfile == "" {
+		cfg.SettingsProfile = def.SettingsProfile
+	}
+	if len(cfg.Settings) == 0 {
+		cfg.Settings = def.Settings
+	}
+	return cfg
+}
+
+// roleCreation holds the creation settings of a role. A role sets them by
+// giving a JSON object as its only creation statement, for example
+//
+//	{"roles": ["analyst"], "quota": "analysts", "statements": ["CREATE USER ..."]}
+//
+// The creation_config fields describe the user to generate, unless statements
+// are given. default_database, quota, settings_profile and settings fill the
+// matching placeholders. Settings the role leaves empty fall back to the
+// connection configuration.
+type roleCreation struct {
+	CreationConfig  `mapstructure:",squash"`
+	Statements      []string `json:"statements" mapstructure:"statements"`
+	DefaultDatabase string   `json:"default_database" mapstructure:"default_database"`
+	Quota           string   `json:"quota" mapstructure:"quota"`
+}
+
+// userSettings returns the settings the role pins, or def when it pins none.
+func (role roleCreation) userSettings(def userSettings) userSettings {
+	if len(role.Settings) > 0 {
+		return role.Settings
+	}
+	return def
+}
+
+// isRoleCreationJSON reports whether commands hold a role creation document
+// rather than SQL.
+func isRoleCreationJSON(commands []string) bool {
+	return len(commands) == 1 && strings.HasPrefix(strings.TrimSpace(commands[0]), "{")
+}
+
+// parseRoleCreation returns the creation settings given by the creation
+// statements of a role. Statements other than a JSON document are returned as
+// is.
+func parseRoleCreation(commands []string) (roleCreation, error) {
+	if !isRoleCreationJSON(commands) {
+		return roleCreation{Statements: commands}, nil
+	}
+
+	// Numbers are kept as written so settings render exactly
+	decoder := json.NewDecoder(bytes.NewReader([]byte(commands[0])))
+	decoder.UseNumber()
+	var raw map[string]interface{}
+	if err := decoder.Decode(&raw); err != nil {
+		return roleCreation{}, fmt.Errorf("failed to parse creation statement as JSON: %w", err)
+	}
+
+	var role roleCreation
+	md, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		WeaklyTypedInput: true,
+		ErrorUnused:      true,
+		Result:           &role,
+	})
+	if err != nil {
+		return roleCreation{}, fmt.Errorf("failed to create creation statement decoder: %w", err)
+	}
+	if err := md.Decode(raw); err != nil {
+		return roleCreation{}, fmt.Errorf("failed to decode creation statement: %w", err)
+	}
+
+	for kind, name := range map[string]string{
+		"default_database": role.DefaultDatabase,
+		"settings_profile": role.SettingsProfile,
+		"quota":            role.Quota,
+	} {
+		if err := validateIdentifier(kind, name); err != nil {
+			return roleCreation{}, err
+		}
+	}
+	return role, nil
+}
+
+// privileges returns the normalized privileges of the grant, from either
+// Privilege or Privileges.
+func (g CreationGrant) privileges() []string {
+	privileges := g.Privileges
+	if g.Privilege != "" {
+		privileges = []string{g.Privilege}
+	}
+
+	normalized := make([]string, 0, len(privileges))
+	for _, privilege := range privileges {
+		normalized = append(normalized, strings.ToUpper(strings.TrimSpace(privilege)))
+	}
+	return normalized
+}
+
+// target returns the quoted object the grant applies to.
+func (g CreationGrant) target() string {
+	table := "*"
+	if g.Table != "" {
+		table = quoteIdentifier(g.Table)
+	}
+	return quoteIdentifier(g.Database) + "." + table
+}
+
+// defaultRolesClause returns the DEFAULT ROLE value for the configured
+// default roles, or ALL, the server default, when there are none. The roles
+// are validated as safe identifiers, so they need no quoting.
+func (cfg CreationConfig) defaultRolesClause() string {
+	if len(cfg.DefaultRoles) == 0 {
+		return "ALL"
+	}
+	return strings.Join(cfg.DefaultRoles, ", ")
+}
+
+// buildCreationStatements returns the CREATE USER and GRANT statements for
+// username, identifying the user according to authType. The user, roles and
+// settings profile are quoted in the quoteStyle identifier_quote style. The
+// password and expiration are left as placeholders so they are substituted
+// like any other creation statement.
+func buildCreationStatements(username string, cfg CreationConfig, authType, quoteStyle string) []string {
+	user := quoteName(username, quoteStyle)
+
+	create := fmt.Sprintf("CREATE USER %s %s VALID UNTIL '{{expiration}}'", user, identifiedClause(authType))
+	var settings []string
+	if cfg.SettingsProfile != "" {
+		settings = append(settings, "PROFILE "+quoteName(cfg.SettingsProfile, quoteStyle))
+	}
+	if len(cfg.Settings) > 0 {
+		settings = append(settings, cfg.Settings.clause())
+	}
+	if len(settings) > 0 {
+		create += " SETTINGS " + strings.Join(settings, ", ")
+	}
+	statements := []string{create}
+
+	if len(cfg.Roles) > 0 {
+		roles := make([]string, 0, len(cfg.Roles))
+		for _, role := range cfg.Roles {
+			roles = append(roles, quoteName(role, quoteStyle))
+		}
+		grant := fmt.Sprintf("GRANT %s TO %s", strings.Join(roles, ", "), user)
+		if cfg.RolesAdminOption {
+			grant += " WITH ADMIN OPTION"
+		}
+		statements = append(statements, grant)
+	}
+	if len(cfg.DefaultRoles) > 0 {
+		statements = append(statements, fmt.Sprintf("SET DEFAULT ROLE %s TO %s", cfg.defaultRolesClause(), user))
+	}
+
+	for _, g := range cfg.Grants {
+		privileges := strings.Join(g.privileges(), ", ")
+		grant := fmt.Sprintf("GRANT %s ON %s TO %s", privileges, g.target(), user)
+		if g.GrantOption {
+			grant += " WITH GRANT OPTION"
+		}
+		statements = append(statements, grant)
+	}
+
+	return statements
+}
+
+// DryRunResult is the outcome of DryRunNewUser.
+type DryRunResult struct {
+	Username   string
+	Statements []string
+}
+
+// DryRunNewUser returns the username and the statements NewUser would run for
+// req, without executing them. Placeholders are substituted and statements are
+// split as they would be for execution, except that the password and its hash
+// are rendered as [password] and [password_hash], as the unsalted hash is as
+// good as the password to anyone able to look it up. The dbplugin interface has no way to return the statements,
+// so this is only reachable by callers embedding the plugin.
+func (c *Clickhouse) DryRunNewUser(req dbplugin.NewUserRequest) (DryRunResult, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	username, statements, values, err := c.creationPlan(req)
+	if err != nil {
+		return DryRunResult{}, err
+	}
+	values["password"] = "[password]"
+	values["password_hash"] = "[password_hash]"
+
+	queries, err := c.renderStatements(statements, values)
+	if err != nil {
+		return DryRunResult{}, err
+	}
+
+	return DryRunResult{Username: username, Statements: queries}, nil
+}
@@ -0,0 +1,519 @@
+// Copyright (c) 2024 Elaunira
+// SPDX-License-Identifier: MPL-2.0
+
+package clickhouse
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	clickhousehelper "github.com/elaunira/openbao-plugin-database-clickhouse/testhelpers/clickhouse"
+	"github.com/openbao/openbao/sdk/v2/database/dbplugin/v5"
+	"github.com/openbao/openbao/sdk/v2/helper/template"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_buildCreationStatements(t *testing.T) {
+	const create = "CREATE USER `v-token-1` IDENTIFIED BY '{{password}}' VALID UNTIL '{{expiration}}'"
+
+	tests := []struct {
+		name     string
+		cfg      CreationConfig
+		expected []string
+	}{
+		{
+			name:     "empty",
+			cfg:      CreationConfig{},
+			expected: []string{create},
+		},
+		{
+			name: "roles only",
+			cfg:  CreationConfig{Roles: []string{"reader", "writer"}},
+			expected: []string{
+				create,
+				"GRANT `reader`, `writer` TO `v-token-1`",
+			},
+		},
+		{
+			name: "grants only",
+			cfg: CreationConfig{
+				Grants: []CreationGrant{
+					{Privilege: "select", Database: "mydb"},
+					{Privilege: "INSERT", Database: "mydb", Table: "events"},
+				},
+			},
+			expected: []string{
+				create,
+				"GRANT SELECT ON `mydb`.* TO `v-token-1`",
+				"GRANT INSERT ON `mydb`.`events` TO `v-token-1`",
+			},
+		},
+		{
+			name: "multiple database grants",
+			cfg: CreationConfig{
+				Grants: []CreationGrant{
+					{Privileges: []string{"select", " SHOW TABLES "}, Database: "sales"},
+					{Privileges: []string{"SELECT"}, Database: "marketing"},
+					{Privileges: []string{"SELECT", "INSERT"}, Database: "staging", Table: "events", GrantOption: true},
+				},
+			},
+			expected: []string{
+				create,
+				"GRANT SELECT, SHOW TABLES ON `sales`.* TO `v-token-1`",
+				"GRANT SELECT ON `marketing`.* TO `v-token-1`",
+				"GRANT SELECT, INSERT ON `staging`.`events` TO `v-token-1` WITH GRANT OPTION",
+			},
+		},
+		{
+			name: "roles, grants and settings profile",
+			cfg: CreationConfig{
+				Roles:           []string{"reader"},
+				Grants:          []CreationGrant{{Privilege: "SELECT", Database: "mydb", Table: "events"}},
+				SettingsProfile: "readonly",
+			},
+			expected: []string{
+				create + " SETTINGS PROFILE `readonly`",
+				"GRANT `reader` TO `v-token-1`",
+				"GRANT SELECT ON `mydb`.`events` TO `v-token-1`",
+			},
+		},
+		{
+			name: "settings",
+			cfg: CreationConfig{
+				Settings: userSettings{"max_memory_usage": 10000000, "readonly": 1},
+			},
+			expected: []string{
+				create + " SETTINGS max_memory_usage = 10000000, readonly = 1",
+			},
+		},
+		{
+			name: "settings with settings profile",
+			cfg: CreationConfig{
+				SettingsProfile: "readonly",
+				Settings:        userSettings{"max_memory_usage": 10000000},
+			},
+			expected: []string{
+				create + " SETTINGS PROFILE `readonly`, max_memory_usage = 10000000",
+			},
+		},
+		{
+			name: "roles with admin option",
+			cfg:  CreationConfig{Roles: []string{"reader"}, RolesAdminOption: true},
+			expected: []string{
+				create,
+				"GRANT `reader` TO `v-token-1` WITH ADMIN OPTION",
+			},
+		},
+		{
+			name: "default roles",
+			cfg:  CreationConfig{Roles: []string{"reader", "writer"}, DefaultRoles: []string{"reader"}},
+			expected: []string{
+				create,
+				"GRANT `reader`, `writer` TO `v-token-1`",
+				"SET DEFAULT ROLE reader TO `v-token-1`",
+			},
+		},
+		{
+			name: "grant with grant option",
+			cfg: CreationConfig{
+				Grants: []CreationGrant{
+					{Privilege: "SELECT", Database: "mydb", GrantOption: true},
+					{Privilege: "INSERT", Database: "mydb"},
+				},
+			},
+			expected: []string{
+				create,
+				"GRANT SELECT ON `mydb`.* TO `v-token-1` WITH GRANT OPTION",
+				"GRANT INSERT ON `mydb`.* TO `v-token-1`",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, tt.cfg.validate())
+			require.Equal(t, tt.expected, buildCreationStatements("v-token-1", tt.cfg, "", identifierQuoteBacktick))
+		})
+	}
+}
+
+func Test_buildCreationStatements_IdentifierQuote(t *testing.T) {
+	cfg := CreationConfig{
+		Roles:           []string{"reader"},
+		SettingsProfile: "readonly",
+		Grants:          []CreationGrant{{Database: "mydb", Table: "events", Privileges: []string{"SELECT"}}},
+	}
+	require.NoError(t, cfg.validate())
+
+	// Database and table names stay identifiers whatever the style
+	require.Equal(t, []string{
+		"CREATE USER 'v-token-1' IDENTIFIED BY '{{password}}' VALID UNTIL '{{expiration}}' SETTINGS PROFILE 'readonly'",
+		"GRANT 'reader' TO 'v-token-1'",
+		"GRANT SELECT ON `mydb`.`events` TO 'v-token-1'",
+	}, buildCreationStatements("v-token-1", cfg, "", identifierQuoteSingle))
+
+	require.Equal(t, []string{
+		`CREATE USER "v-token-1" IDENTIFIED BY '{{password}}' VALID UNTIL '{{expiration}}' SETTINGS PROFILE "readonly"`,
+		`GRANT "reader" TO "v-token-1"`,
+		"GRANT SELECT ON `mydb`.`events` TO \"v-token-1\"",
+	}, buildCreationStatements("v-token-1", cfg, "", identifierQuoteDouble))
+
+	// An unset style quotes like single
+	require.Equal(t, buildCreationStatements("v-token-1", cfg, "", identifierQuoteSingle),
+		buildCreationStatements("v-token-1", cfg, "", ""))
+}
+
+func TestCreationConfig_validate(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       CreationConfig
+		expectErr string
+	}{
+		{name: "empty role", cfg: CreationConfig{Roles: []string{""}}, expectErr: "role names must not be empty"},
+		{
+			name:      "invalid privilege",
+			cfg:       CreationConfig{Grants: []CreationGrant{{Privilege: "SELECT; DROP", Database: "mydb"}}},
+			expectErr: "invalid privilege",
+		},
+		{
+			name:      "invalid privilege in list",
+			cfg:       CreationConfig{Grants: []CreationGrant{{Privileges: []string{"SELECT", "ALL; DROP"}, Database: "mydb"}}},
+			expectErr: `invalid privilege "ALL; DROP"`,
+		},
+		{
+			name:      "missing privilege",
+			cfg:       CreationConfig{Grants: []CreationGrant{{Database: "mydb"}}},
+			expectErr: "a privilege is required",
+		},
+		{
+			name: "privilege and privileges",
+			cfg: CreationConfig{
+				Grants: []CreationGrant{{Privilege: "SELECT", Privileges: []string{"INSERT"}, Database: "mydb"}},
+			},
+			expectErr: "mutually exclusive",
+		},
+		{
+			name:      "database with control character",
+			cfg:       CreationConfig{Grants: []CreationGrant{{Privileges: []string{"SELECT"}, Database: "my\ndb"}}},
+			expectErr: "contains a control character",
+		},
+		{
+			name:      "missing database",
+			cfg:       CreationConfig{Grants: []CreationGrant{{Privilege: "SELECT"}}},
+			expectErr: "database is required",
+		},
+		{
+			name:      "default role not granted",
+			cfg:       CreationConfig{Roles: []string{"reader"}, DefaultRoles: []string{"writer"}},
+			expectErr: `default role "writer" is not one of the granted roles`,
+		},
+		{
+			name:      "unsafe default role",
+			cfg:       CreationConfig{Roles: []string{"read-er"}, DefaultRoles: []string{"read-er"}},
+			expectErr: "is not a valid identifier",
+		},
+		{
+			name:      "unsafe setting name",
+			cfg:       CreationConfig{Settings: userSettings{"readonly = 0, x": 1}},
+			expectErr: "is not a valid identifier",
+		},
+		{
+			name:      "non-scalar setting value",
+			cfg:       CreationConfig{Settings: userSettings{"readonly": []int{1}}},
+			expectErr: "must be a string, number or boolean",
+		},
+		{
+			name:      "admin option without roles",
+			cfg:       CreationConfig{RolesAdminOption: true},
+			expectErr: "roles_admin_option requires roles",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.validate()
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tt.expectErr)
+		})
+	}
+}
+
+func TestClickhouse_NewUser_WithCreationConfig(t *testing.T) {
+	cleanup, connURL := clickhousehelper.PrepareTestContainer(t, false, testAdminUser, testAdminPassword)
+	defer cleanup()
+
+	db := newTestClickhouse(t)
+	_, err := db.Initialize(context.Background(), dbplugin.InitializeRequest{
+		Config: map[string]interface{}{
+			"connection_url": connURL,
+			"creation_config": map[string]interface{}{
+				"grants": []map[string]interface{}{
+					{"privilege": "SELECT", "database": "system", "table": "one"},
+				},
+			},
+		},
+		VerifyConnection: true,
+	})
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+
+	resp, err := db.NewUser(context.Background(), dbplugin.NewUserRequest{
+		UsernameConfig: dbplugin.UsernameMetadata{
+			DisplayName: "token",
+			RoleName:    testRole,
+		},
+		Password:   testPassword,
+		Expiration: time.Now().Add(time.Hour),
+	})
+	require.NoError(t, err)
+
+	exists, err := db.userExists(context.Background(), resp.Username)
+	require.NoError(t, err)
+	require.True(t, exists)
+}
+
+func TestClickhouse_DryRunNewUser(t *testing.T) {
+	db := newTestClickhouse(t)
+	up, err := template.NewTemplate(template.Template(`{{ printf "v-%s-%s" .DisplayName .RoleName }}`))
+	require.NoError(t, err)
+	db.usernameProducer = up
+	require.NoError(t, db.Init(context.Background(), map[string]interface{}{
+		"connection_url":      "clickhouse://localhost:9000",
+		"expiration_timezone": "UTC",
+		"default_database":    "analytics",
+	}, false))
+
+	result, err := db.DryRunNewUser(dbplugin.NewUserRequest{
+		UsernameConfig: dbplugin.UsernameMetadata{DisplayName: "token", RoleName: "reader"},
+		Statements: dbplugin.Statements{
+			Commands: []string{
+				"CREATE USER '{{name}}' IDENTIFIED BY '{{password}}' VALID UNTIL '{{expiration}}'; GRANT SELECT ON {{default_database}}.* TO '{{name}}'",
+			},
+		},
+		Password:   "s3cr3t-pass",
+		Expiration: time.Date(2099, 1, 2, 3, 4, 5, 0, time.UTC),
+	})
+	require.NoError(t, err)
+	require.Equal(t, "v-token-reader", result.Username)
+	require.Equal(t, []string{
+		"CREATE USER 'v-token-reader' IDENTIFIED BY '[password]' VALID UNTIL '2099-01-02 03:04:05'",
+		"GRANT SELECT ON analytics.* TO 'v-token-reader'",
+	}, result.Statements)
+
+	// Nothing was executed, so no pool was opened
+	require.Nil(t, db.db)
+
+	_, err = db.DryRunNewUser(dbplugin.NewUserRequest{})
+	require.ErrorIs(t, err, ErrNoCreationStatements)
+}
+
+func TestClickhouse_DryRunNewUser_Cluster(t *testing.T) {
+	db := newTestClickhouse(t)
+	require.NoError(t, db.Init(context.Background(), map[string]interface{}{
+		"connection_url": "clickhouse://localhost:9000",
+		"cluster":        "prod-cluster",
+	}, false))
+
+	result, err := db.DryRunNewUser(dbplugin.NewUserRequest{
+		UsernameConfig: dbplugin.UsernameMetadata{DisplayName: "token", RoleName: "reader"},
+		Statements: dbplugin.Statements{
+			Commands: []string{"CREATE USER '{{name}}' ON CLUSTER '{{cluster}}' IDENTIFIED BY '{{password}}'"},
+		},
+		Password: "s3cr3t-pass",
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"CREATE USER '" + result.Username + "' ON CLUSTER 'prod-cluster' IDENTIFIED BY '[password]'",
+	}, result.Statements)
+}
+
+func TestClickhouse_DryRunNewUser_UsernameCase(t *testing.T) {
+	db := newTestClickhouse(t)
+	require.NoError(t, db.Init(context.Background(), map[string]interface{}{
+		"connection_url": "clickhouse://localhost:9000",
+		"username_case":  "lower",
+	}, false))
+
+	result, err := db.DryRunNewUser(dbplugin.NewUserRequest{
+		UsernameConfig: dbplugin.UsernameMetadata{DisplayName: "Token", RoleName: "Reader"},
+		Statements: dbplugin.Statements{
+			Commands: []string{"CREATE USER '{{name}}' IDENTIFIED BY '{{password}}'"},
+		},
+		Password:   "s3cr3t-pass",
+		Expiration: time.Now().Add(time.Hour),
+	})
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(result.Username, "v-token-reader-"))
+	require.Equal(t, strings.ToLower(result.Username), result.Username)
+	require.Contains(t, result.Statements[0], "'"+result.Username+"'")
+
+	err = newTestClickhouse(t).Init(context.Background(), map[string]interface{}{
+		"connection_url": "clickhouse://localhost:9000",
+		"username_case":  "title",
+	}, false)
+	require.ErrorContains(t, err, "invalid username_case")
+}
+
+func TestClickhouse_DryRunNewUser_UsernameAffixes(t *testing.T) {
+	req := dbplugin.NewUserRequest{
+		UsernameConfig: dbplugin.UsernameMetadata{DisplayName: "token", RoleName: "reader"},
+		Statements: dbplugin.Statements{
+			Commands: []string{"CREATE USER '{{name}}' IDENTIFIED BY '{{password}}'"},
+		},
+		Password:   "s3cr3t-pass",
+		Expiration: time.Now().Add(time.Hour),
+	}
+
+	db := newTestClickhouse(t)
+	require.NoError(t, db.Init(context.Background(), map[string]interface{}{
+		"connection_url":  "clickhouse://localhost:9000",
+		"username_prefix": "prod_",
+		"username_suffix": "_rw",
+	}, false))
+
+	result, err := db.DryRunNewUser(req)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(result.Username, "prod_v-token-reader-"), result.Username)
+	require.True(t, strings.HasSuffix(result.Username, "_rw"), result.Username)
+	require.LessOrEqual(t, len(result.Username), maxUsernameLength)
+
+	// The default template produces up to 32 characters, so a 40 character
+	// prefix pushes the result over the limit
+	db = newTestClickhouse(t)
+	require.NoError(t, db.Init(context.Background(), map[string]interface{}{
+		"connection_url":  "clickhouse://localhost:9000",
+		"username_prefix": strings.Repeat("p", 40),
+	}, false))
+	_, err = db.DryRunNewUser(req)
+	require.ErrorContains(t, err, "is longer than 64 characters")
+
+	err = newTestClickhouse(t).Init(context.Background(), map[string]interface{}{
+		"connection_url":  "clickhouse://localhost:9000",
+		"username_prefix": strings.Repeat("p", 40),
+		"username_suffix": strings.Repeat("s", 24),
+	}, false)
+	require.ErrorContains(t, err, "leave no room for the generated username")
+
+	err = newTestClickhouse(t).Init(context.Background(), map[string]interface{}{
+		"connection_url":  "clickhouse://localhost:9000",
+		"username_prefix": "prod'",
+	}, false)
+	require.ErrorContains(t, err, "invalid username_prefix")
+}
+
+func TestClickhouse_DryRunNewUser_DefaultRoles(t *testing.T) {
+	req := dbplugin.NewUserRequest{
+		UsernameConfig: dbplugin.UsernameMetadata{DisplayName: "token", RoleName: "reader"},
+		Statements: dbplugin.Statements{
+			Commands: []string{"CREATE USER '{{name}}' IDENTIFIED BY '{{password}}' DEFAULT ROLE {{default_roles}}"},
+		},
+		Password: "s3cr3t-pass",
+	}
+
+	// Without default roles the server default is kept
+	db := newTestClickhouse(t)
+	require.NoError(t, db.Init(context.Background(), map[string]interface{}{
+		"connection_url": "clickhouse://localhost:9000",
+	}, false))
+	result, err := db.DryRunNewUser(req)
+	require.NoError(t, err)
+	require.True(t, strings.HasSuffix(result.Statements[0], " DEFAULT ROLE ALL"), result.Statements[0])
+
+	db = newTestClickhouse(t)
+	require.NoError(t, db.Init(context.Background(), map[string]interface{}{
+		"connection_url": "clickhouse://localhost:9000",
+		"creation_config": map[string]interface{}{
+			"roles":         []string{"reader", "writer", "auditor"},
+			"default_roles": []string{"reader", "auditor"},
+		},
+	}, false))
+	result, err = db.DryRunNewUser(req)
+	require.NoError(t, err)
+	require.True(t, strings.HasSuffix(result.Statements[0], " DEFAULT ROLE reader, auditor"), result.Statements[0])
+}
+
+func Test_parseRoleCreation(t *testing.T) {
+	// SQL statements are returned as is
+	role, err := parseRoleCreation([]string{"CREATE USER '{{name}}'"})
+	require.NoError(t, err)
+	require.Equal(t, roleCreation{Statements: []string{"CREATE USER '{{name}}'"}}, role)
+
+	role, err = parseRoleCreation([]string{`{
+		"roles": ["analyst"],
+		"settings_profile": "readonly",
+		"settings": {"max_memory_usage": 10000000},
+		"default_database": "sales",
+		"quota": "analysts",
+		"statements": ["CREATE USER '{{name}}' QUOTA {{quota}}"]
+	}`})
+	require.NoError(t, err)
+	require.Equal(t, []string{"analyst"}, role.Roles)
+	require.Equal(t, "readonly", role.SettingsProfile)
+	require.Equal(t, "max_memory_usage = 10000000", role.Settings.clause())
+	require.Equal(t, "sales", role.DefaultDatabase)
+	require.Equal(t, "analysts", role.Quota)
+	require.Equal(t, []string{"CREATE USER '{{name}}' QUOTA {{quota}}"}, role.Statements)
+
+	_, err = parseRoleCreation([]string{`{"roles": ["analyst"`})
+	require.ErrorContains(t, err, "failed to parse creation statement as JSON")
+	_, err = parseRoleCreation([]string{`{"role": "analyst"}`})
+	require.ErrorContains(t, err, "role")
+	_, err = parseRoleCreation([]string{`{"quota": "x; DROP USER admin"}`})
+	require.ErrorContains(t, err, "quota")
+}
+
+func TestClickhouse_DryRunNewUser_RoleCreation(t *testing.T) {
+	db := newTestClickhouse(t)
+	require.NoError(t, db.Init(context.Background(), map[string]interface{}{
+		"connection_url":   "clickhouse://localhost:9000",
+		"default_database": "analytics",
+		"quota":            "default_quota",
+		"creation_config": map[string]interface{}{
+			"roles":            []string{"reader"},
+			"settings_profile": "default_profile",
+		},
+	}, false))
+
+	// Each role describes its own users; what it leaves out comes from the
+	// connection
+	result, err := db.DryRunNewUser(dbplugin.NewUserRequest{
+		UsernameConfig: dbplugin.UsernameMetadata{DisplayName: "token", RoleName: "writer"},
+		Statements: dbplugin.Statements{
+			Commands: []string{`{"roles": ["writer"], "grants": [{"privilege": "INSERT", "database": "sales"}]}`},
+		},
+		Password:   "s3cr3t-pass",
+		Expiration: time.Date(2099, 1, 2, 3, 4, 5, 0, time.UTC),
+	})
+	require.NoError(t, err)
+	user := "'" + result.Username + "'"
+	require.Equal(t, []string{
+		"CREATE USER " + user + " IDENTIFIED BY '[password]' VALID UNTIL '2099-01-02 03:04:05' SETTINGS PROFILE 'default_profile'",
+		"GRANT 'writer' TO " + user,
+		"GRANT INSERT ON `sales`.* TO " + user,
+	}, result.Statements)
+
+	// Placeholders take the role's values over the connection's
+	result, err = db.DryRunNewUser(dbplugin.NewUserRequest{
+		UsernameConfig: dbplugin.UsernameMetadata{DisplayName: "token", RoleName: "reader"},
+		Statements: dbplugin.Statements{
+			Commands: []string{`{
+				"quota": "reader_quota",
+				"statements": ["CREATE USER '{{name}}' IDENTIFIED BY '{{password}}' DEFAULT DATABASE {{default_database}} QUOTA {{quota}}"]
+			}`},
+		},
+		Password: "s3cr3t-pass",
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"CREATE USER '" + result.Username + "' IDENTIFIED BY '[password]' DEFAULT DATABASE analytics QUOTA reader_quota",
+	}, result.Statements)
+
+	// The merged settings are validated
+	_, err = db.DryRunNewUser(dbplugin.NewUserRequest{
+		Statements: dbplugin.Statements{Commands: []string{`{"default_roles": ["auditor"]}`}},
+		Password:   "s3cr3t-pass",
+	})
+	require.ErrorContains(t, err, `default role "auditor" is not one of the granted roles`)
+}
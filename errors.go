@@ -0,0 +1,176 @@
+// Copyright (c) 2024 Elaunira
+// SPDX-License-Identifier: MPL-2.0
+
+package clickhouse
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	ch "github.com/ClickHouse/clickhouse-go/v2"
+)
+
+var (
+	// ErrNotInitialized is returned when a connection is requested before the
+	// plugin was initialized, or after it was closed.
+	ErrNotInitialized = errors.New("connection producer not initialized")
+
+	// ErrNoChanges is returned by UpdateUser when the request changes neither
+	// the password nor the expiration, and by RenameUser when the new name
+	// equals the current one.
+	ErrNoChanges = errors.New("no changes requested")
+
+	// ErrNoCreationStatements is returned by NewUser when the role has no
+	// creation statements and no creation_config is configured.
+	ErrNoCreationStatements = errors.New("no creation statements provided")
+
+	// ErrEmptyPassword is returned by NewUser when the creation statements
+	// set a password but none was provided. Users with an external auth_type
+	// don't need one.
+	ErrEmptyPassword = errors.New("password must not be empty")
+
+	// ErrPasswordQuotes is returned by NewUser and UpdateUser when the
+	// password contains a quote or backslash and password_quote_mode is
+	// reject.
+	ErrPasswordQuotes = errors.New("password must not contain quotes or backslashes")
+
+	// ErrProtectedUser is returned by DeleteUser and RevokeUser for the admin
+	// user the plugin connects as and the users listed in protected_users.
+	ErrProtectedUser = errors.New("user is protected")
+
+	// ErrExpirationInPast is returned by NewUser when the creation statements
+	// use the expiration and it is not in the future.
+	ErrExpirationInPast = errors.New("expiration must be in the future")
+
+	// ErrAuthenticationFailed is returned by Init when ClickHouse rejects the
+	// configured credentials.
+	ErrAuthenticationFailed = errors.New("authentication failed: check username/password")
+
+	// ErrUnsupportedServerVersion is returned when a statement uses a feature
+	// the connected ClickHouse server is too old to support.
+	ErrUnsupportedServerVersion = errors.New("unsupported by the ClickHouse server version")
+)
+
+// codeAccessEntityAlreadyExists is the ClickHouse error code returned when a
+// user, role or other access entity is created with a name already in use.
+const codeAccessEntityAlreadyExists = 493
+
+// codeAccessStorageReadonly and codeAccessDenied are returned when the
+// configured user cannot manage users, either because its access storage is
+// read-only or because it lacks the privilege.
+const (
+	codeAccessStorageReadonly = 495
+	codeAccessDenied          = 497
+)
+
+// codeAuthenticationFailed is the ClickHouse error code returned when the
+// username or password is wrong.
+const codeAuthenticationFailed = 516
+
+// transientCodes are ClickHouse error codes for conditions expected to clear
+// up on their own, so the statement is worth retrying.
+var transientCodes = map[int32]bool{
+	202: true, // TOO_MANY_SIMULTANEOUS_QUERIES
+	209: true, // SOCKET_TIMEOUT
+	210: true, // NETWORK_ERROR
+	225: true, // NO_ZOOKEEPER
+	242: true, // TABLE_IS_READ_ONLY
+	999: true, // KEEPER_EXCEPTION
+}
+
+// accessManagementGuidance is added to errors caused by missing access
+// management privileges.
+const accessManagementGuidance = "the configured user needs access_management privileges: " +
+	"set access_management to 1 for it in users.xml, or grant it ACCESS MANAGEMENT ON *.* WITH GRANT OPTION"
+
+// httpExceptionCodePattern extracts the error code from exceptions returned
+// over the HTTP interface, which are not decoded into ch.Exception.
+var httpExceptionCodePattern = regexp.MustCompile(`Code: (\d+)\.`)
+
+// UserExistsError is returned by NewUser when the generated username is
+// already in use. It is retryable: generating a new username and repeating
+// the request is expected to succeed.
+type UserExistsError struct {
+	Username string
+	Err      error
+}
+
+func (e *UserExistsError) Error() string {
+	return fmt.Sprintf("user %q already exists", e.Username)
+}
+
+func (e *UserExistsError) Unwrap() error {
+	return e.Err
+}
+
+// Retryable reports that the request can be retried with a new username.
+func (e *UserExistsError) Retryable() bool {
+	return true
+}
+
+// exceptionCode returns the ClickHouse error code carried by err, if any.
+func exceptionCode(err error) (int32, bool) {
+	var exception *ch.Exception
+	if errors.As(err, &exception) {
+		return exception.Code, true
+	}
+
+	m := httpExceptionCodePattern.FindStringSubmatch(err.Error())
+	if m == nil {
+		return 0, false
+	}
+	code, convErr := strconv.ParseInt(m[1], 10, 32)
+	if convErr != nil {
+		return 0, false
+	}
+	return int32(code), true
+}
+
+// isTransientError reports whether err carries one of the transientCodes.
+func isTransientError(err error) bool {
+	code, ok := exceptionCode(err)
+	return ok && transientCodes[code]
+}
+
+// isAccessManagementError reports whether err was caused by the configured
+// user lacking access management privileges.
+func isAccessManagementError(err error) bool {
+	if code, ok := exceptionCode(err); ok {
+		return code == codeAccessDenied || code == codeAccessStorageReadonly
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "ACCESS_DENIED") || strings.Contains(msg, "ACCESS_STORAGE_READONLY")
+}
+
+// withAccessManagementGuidance wraps errors caused by missing access
+// management privileges with a hint on how to fix it. Other errors are
+// returned unchanged.
+func withAccessManagementGuidance(err error) error {
+	if err == nil || !isAccessManagementError(err) {
+		return err
+	}
+	return fmt.Errorf("%s: %w", accessManagementGuidance, err)
+}
+
+// isAuthenticationError reports whether err was caused by ClickHouse rejecting
+// the credentials.
+func isAuthenticationError(err error) bool {
+	if code, ok := exceptionCode(err); ok {
+		return code == codeAuthenticationFailed
+	}
+	return strings.Contains(err.Error(), "AUTHENTICATION_FAILED")
+}
+
+// mapAuthenticationError replaces authentication failures with
+// ErrAuthenticationFailed. The driver error is dropped rather than wrapped, as
+// it can echo the connection URL and with it the password. Other errors are
+// returned unchanged.
+func mapAuthenticationError(err error) error {
+	if err == nil || !isAuthenticationError(err) {
+		return err
+	}
+	return fmt.Errorf("%w (code %d)", ErrAuthenticationFailed, codeAuthenticationFailed)
+}
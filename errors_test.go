@@ -0,0 +1,215 @@
+// Copyright (c) 2024 Elaunira
+// SPDX-License-Identifier: MPL-2.0
+
+package clickhouse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	ch "github.com/ClickHouse/clickhouse-go/v2"
+	clickhousehelper "github.com/elaunira/openbao-plugin-database-clickhouse/testhelpers/clickhouse"
+	"github.com/openbao/openbao/sdk/v2/database/dbplugin/v5"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_exceptionCode(t *testing.T) {
+	tests := []struct {
+		name         string
+		err          error
+		expectedCode int32
+		expectedOK   bool
+	}{
+		{
+			name:         "native exception",
+			err:          fmt.Errorf("wrapped: %w", &ch.Exception{Code: 493, Message: "user already exists"}),
+			expectedCode: 493,
+			expectedOK:   true,
+		},
+		{
+			name:         "http exception",
+			err:          errors.New("sendQuery: [HTTP 500] response body: \"Code: 493. DB::Exception: user `x` already exists. (ACCESS_ENTITY_ALREADY_EXISTS)\""),
+			expectedCode: 493,
+			expectedOK:   true,
+		},
+		{
+			name: "no code",
+			err:  errors.New("connection refused"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, ok := exceptionCode(tt.err)
+			require.Equal(t, tt.expectedOK, ok)
+			require.Equal(t, tt.expectedCode, code)
+		})
+	}
+}
+
+func Test_mapAuthenticationError(t *testing.T) {
+	const password = "s3cr3t"
+
+	tests := []struct {
+		name       string
+		err        error
+		expectAuth bool
+	}{
+		{
+			name:       "native exception",
+			err:        fmt.Errorf("ping: %w", &ch.Exception{Code: 516, Message: "admin: Authentication failed: password is incorrect, or there is no user with such name."}),
+			expectAuth: true,
+		},
+		{
+			name:       "http exception",
+			err:        errors.New("sendQuery: [HTTP 516] response body: \"Code: 516. DB::Exception: admin: Authentication failed. (AUTHENTICATION_FAILED)\" url: http://admin:" + password + "@localhost:8123"),
+			expectAuth: true,
+		},
+		{
+			name: "other exception",
+			err:  &ch.Exception{Code: 62, Message: "Syntax error"},
+		},
+		{
+			name: "no code",
+			err:  errors.New("connection refused"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := mapAuthenticationError(tt.err)
+			if !tt.expectAuth {
+				require.Equal(t, tt.err, err)
+				return
+			}
+			require.ErrorIs(t, err, ErrAuthenticationFailed)
+			require.Contains(t, err.Error(), "check username/password")
+			require.NotContains(t, err.Error(), password)
+		})
+	}
+
+	require.NoError(t, mapAuthenticationError(nil))
+}
+
+func TestClickhouse_NewUser_AlreadyExists(t *testing.T) {
+	cleanup, connURL := clickhousehelper.PrepareTestContainer(t, false, testAdminUser, testAdminPassword)
+	defer cleanup()
+
+	db := newTestClickhouse(t)
+	_, err := db.Initialize(context.Background(), dbplugin.InitializeRequest{
+		Config: map[string]interface{}{
+			"connection_url":    connURL,
+			"username_template": "fixed-user",
+		},
+		VerifyConnection: true,
+	})
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+
+	req := dbplugin.NewUserRequest{
+		UsernameConfig: dbplugin.UsernameMetadata{
+			DisplayName: "token",
+			RoleName:    testRole,
+		},
+		Statements: dbplugin.Statements{
+			Commands: []string{
+				"CREATE USER '{{name}}' IDENTIFIED BY '{{password}}'",
+			},
+		},
+		Password:   testPassword,
+		Expiration: time.Now().Add(time.Hour),
+	}
+
+	resp, err := db.NewUser(context.Background(), req)
+	require.NoError(t, err)
+	require.Equal(t, "fixed-user", resp.Username)
+
+	_, err = db.NewUser(context.Background(), req)
+	require.Error(t, err)
+
+	var existsErr *UserExistsError
+	require.ErrorAs(t, err, &existsErr)
+	require.Equal(t, "fixed-user", existsErr.Username)
+	require.True(t, existsErr.Retryable())
+}
+
+func Test_withAccessManagementGuidance(t *testing.T) {
+	tests := []struct {
+		name         string
+		err          error
+		expectGuided bool
+	}{
+		{
+			name:         "native access denied",
+			err:          &ch.Exception{Code: 497, Message: "admin: Not enough privileges. To execute this query, it's necessary to have the grant CREATE USER ON *.*"},
+			expectGuided: true,
+		},
+		{
+			name:         "native readonly storage",
+			err:          &ch.Exception{Code: 495, Message: "Cannot insert user `v-token` to users_xml: storage is readonly"},
+			expectGuided: true,
+		},
+		{
+			name:         "http access denied",
+			err:          errors.New("Code: 497. DB::Exception: admin: Not enough privileges. (ACCESS_DENIED)"),
+			expectGuided: true,
+		},
+		{
+			name:         "error name without code",
+			err:          errors.New("statement failed: ACCESS_DENIED"),
+			expectGuided: true,
+		},
+		{
+			name: "syntax error",
+			err:  &ch.Exception{Code: 62, Message: "Syntax error"},
+		},
+		{
+			name: "connection error",
+			err:  errors.New("connection refused"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := withAccessManagementGuidance(tt.err)
+			require.ErrorIs(t, err, tt.err)
+			if tt.expectGuided {
+				require.Contains(t, err.Error(), "the configured user needs access_management privileges")
+			} else {
+				require.Equal(t, tt.err, err)
+			}
+		})
+	}
+
+	require.NoError(t, withAccessManagementGuidance(nil))
+}
+
+func TestClickhouse_SentinelErrors(t *testing.T) {
+	db := newTestClickhouse(t)
+
+	_, err := db.Connection(context.Background())
+	require.ErrorIs(t, err, ErrNotInitialized)
+
+	err = db.HealthCheck(context.Background())
+	require.ErrorIs(t, err, ErrNotInitialized)
+
+	_, err = db.NewUser(context.Background(), dbplugin.NewUserRequest{
+		UsernameConfig: dbplugin.UsernameMetadata{DisplayName: "token", RoleName: testRole},
+		Password:       testPassword,
+	})
+	require.ErrorIs(t, err, ErrNoCreationStatements)
+
+	_, err = db.UpdateUser(context.Background(), dbplugin.UpdateUserRequest{Username: "testuser"})
+	require.ErrorIs(t, err, ErrNoChanges)
+
+	// Closing makes the producer uninitialized again
+	require.NoError(t, db.Init(context.Background(), map[string]interface{}{
+		"connection_url": "clickhouse://localhost:9000",
+	}, false))
+	require.NoError(t, db.Close())
+	_, err = db.Connection(context.Background())
+	require.ErrorIs(t, err, ErrNotInitialized)
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2024 Elaunira
+// SPDX-License-Identifier: MPL-2.0
+
+package clickhouse
+
+import (
+	"context"
+	"time"
+)
+
+// multipleAuthVersion is the first ClickHouse release accepting several
+// authentication methods per user, which the rotation grace period relies on.
+var multipleAuthVersion = [2]int{24, 9}
+
+// resetAuthStatement drops every authentication method of a user except the
+// one added last.
+const resetAuthStatement = `ALTER USER IF EXISTS '{{name}}' RESET AUTHENTICATION METHODS TO NEW`
+
+// pendingReset is a scheduled removal of the passwords replaced by a rotation.
+type pendingReset struct {
+	// stop cancels the timer, reporting whether it had not fired yet.
+	stop func() bool
+	// run removes the old passwords. The caller must hold the lock.
+	run func()
+}
+
+// graceRotationStatement returns the statement adding the new password next
+// to the current one, for rotations with a grace period.
+func graceRotationStatement(authType string) string {
+	return "ALTER USER IF EXISTS '{{name}}' ADD " + identifiedClause(authType)
+}
+
+// scheduleReset removes the previous passwords of username once the grace
+// period is over. A rotation still pending for the same user is superseded:
+// the reset keeps only the newest password, so one timer covers both. The
+// caller must hold the lock.
+func (c *Clickhouse) scheduleReset(username string) {
+	if previous, ok := c.pendingResets[username]; ok {
+		previous.stop()
+	}
+
+	reset := &pendingReset{
+		run: func() {
+			err := c.executeStatementsWithMap(context.Background(), []string{requoteNames(resetAuthStatement, c.IdentifierQuote)}, errorModeStop, map[string]string{
+				"name":     username,
+				"username": username,
+				"cluster":  c.Cluster,
+			})
+			if err != nil {
+				c.log().Warn("failed to remove previous password after grace period", "username", username, "error", err)
+			}
+		},
+	}
+	reset.stop = c.afterFunc(c.RotationGracePeriod, func() {
+		c.Lock()
+		defer c.Unlock()
+
+		// A newer rotation or Close may have taken over
+		if c.pendingResets[username] != reset {
+			return
+		}
+		delete(c.pendingResets, username)
+		reset.run()
+	})
+
+	if c.pendingResets == nil {
+		c.pendingResets = make(map[string]*pendingReset)
+	}
+	c.pendingResets[username] = reset
+}
+
+// flushPendingResets removes the previous passwords of every rotation still
+// in its grace period right away, so they don't outlive the plugin. The
+// caller must hold the lock.
+func (c *clickhouseConnectionProducer) flushPendingResets() {
+	for username, reset := range c.pendingResets {
+		delete(c.pendingResets, username)
+		if reset.stop() {
+			reset.run()
+		}
+	}
+}
+
+// afterFunc runs f after d, returning a function that cancels it. It defaults
+// to time.AfterFunc.
+func (c *clickhouseConnectionProducer) afterFunc(d time.Duration, f func()) func() bool {
+	if c.timerFunc != nil {
+		return c.timerFunc(d, f)
+	}
+	return time.AfterFunc(d, f).Stop
+}
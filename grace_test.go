@@ -0,0 +1,189 @@
+// Copyright (c) 2024 Elaunira
+// SPDX-License-Identifier: MPL-2.0
+
+package clickhouse
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	clickhousehelper "github.com/elaunira/openbao-plugin-database-clickhouse/testhelpers/clickhouse"
+	"github.com/hashicorp/go-hclog"
+	"github.com/openbao/openbao/sdk/v2/database/dbplugin/v5"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTimer is a scheduled function of fakeClock.
+type fakeTimer struct {
+	d       time.Duration
+	f       func()
+	stopped bool
+}
+
+// fakeClock records the functions scheduled through timerFunc, which only run
+// when the test fires them.
+type fakeClock struct {
+	timers []*fakeTimer
+}
+
+func (c *fakeClock) afterFunc(d time.Duration, f func()) func() bool {
+	timer := &fakeTimer{d: d, f: f}
+	c.timers = append(c.timers, timer)
+	return func() bool {
+		wasPending := !timer.stopped
+		timer.stopped = true
+		return wasPending
+	}
+}
+
+func Test_graceRotationStatement(t *testing.T) {
+	require.Equal(t, "ALTER USER IF EXISTS '{{name}}' ADD IDENTIFIED BY '{{password}}'", graceRotationStatement(""))
+	require.Equal(t, "ALTER USER IF EXISTS '{{name}}' ADD IDENTIFIED WITH sha256_password BY '{{password}}'", graceRotationStatement(authSHA256Password))
+}
+
+func TestClickhouse_scheduleReset(t *testing.T) {
+	db := newTestClickhouse(t)
+	require.NoError(t, db.Init(context.Background(), map[string]interface{}{
+		"connection_url":        "clickhouse://localhost:9000",
+		"rotation_grace_period": "15m",
+	}, false))
+	clock := &fakeClock{}
+	db.timerFunc = clock.afterFunc
+	var buf bytes.Buffer
+	db.WithLogger(hclog.New(&hclog.LoggerOptions{Output: &buf, Level: hclog.Warn}))
+	// Keep the reset from reaching a server
+	db.initialized = false
+
+	db.Lock()
+	db.scheduleReset("v-token-1")
+	db.Unlock()
+	require.Len(t, clock.timers, 1)
+	require.Equal(t, 15*time.Minute, clock.timers[0].d)
+
+	// A second rotation within the grace period supersedes the first
+	db.Lock()
+	db.scheduleReset("v-token-1")
+	db.Unlock()
+	require.Len(t, clock.timers, 2)
+	require.True(t, clock.timers[0].stopped)
+	require.Len(t, db.pendingResets, 1)
+
+	// A superseded timer firing anyway does nothing
+	clock.timers[0].f()
+	require.Empty(t, buf.String())
+	require.Len(t, db.pendingResets, 1)
+
+	// The old passwords are removed when the grace period ends
+	clock.timers[1].f()
+	require.Empty(t, db.pendingResets)
+	require.Equal(t, 1, strings.Count(buf.String(), "failed to remove previous password"))
+
+	// Close ends pending grace periods early instead of leaving the old
+	// passwords valid
+	buf.Reset()
+	db.Lock()
+	db.scheduleReset("v-token-2")
+	require.NoError(t, db.clickhouseConnectionProducer.Close())
+	db.Unlock()
+	require.True(t, clock.timers[2].stopped)
+	require.Empty(t, db.pendingResets)
+	require.Contains(t, buf.String(), "v-token-2")
+}
+
+func TestClickhouse_scheduleReset_Reinitialize(t *testing.T) {
+	conf := map[string]interface{}{
+		"connection_url":        "clickhouse://localhost:9000",
+		"rotation_grace_period": "15m",
+	}
+	db := newTestClickhouse(t)
+	require.NoError(t, db.Init(context.Background(), conf, false))
+	clock := &fakeClock{}
+	db.timerFunc = clock.afterFunc
+
+	db.Lock()
+	db.scheduleReset("v-token-1")
+	db.Unlock()
+
+	// Re-initializing replaces the pool but leaves the grace period running
+	require.NoError(t, db.Init(context.Background(), conf, false))
+	require.Len(t, clock.timers, 1)
+	require.False(t, clock.timers[0].stopped)
+	require.Len(t, db.pendingResets, 1)
+}
+
+func TestClickhouse_UpdateUser_GracePeriodUnsupportedVersion(t *testing.T) {
+	db := newTestClickhouse(t)
+	require.NoError(t, db.Init(context.Background(), map[string]interface{}{
+		"connection_url":        "clickhouse://localhost:9000",
+		"rotation_grace_period": "15m",
+	}, false))
+	db.version = "24.8.4.13"
+
+	_, err := db.UpdateUser(context.Background(), dbplugin.UpdateUserRequest{
+		Username: "v-token-1",
+		Password: &dbplugin.ChangePassword{NewPassword: testPassword},
+	})
+	require.ErrorIs(t, err, ErrUnsupportedServerVersion)
+
+	err = newTestClickhouse(t).Init(context.Background(), map[string]interface{}{
+		"connection_url":        "clickhouse://localhost:9000",
+		"rotation_grace_period": "-1s",
+	}, false)
+	require.ErrorContains(t, err, "rotation_grace_period must not be negative")
+}
+
+// multipleAuthImage is a clickhouse-server image recent enough for rotation
+// grace periods.
+const multipleAuthImage = "25.3-alpine"
+
+func TestClickhouse_UpdateUser_GracePeriod(t *testing.T) {
+	// The default image predates multiple authentication methods per user
+	cleanup, connURL := clickhousehelper.PrepareTestContainerWithImage(t, multipleAuthImage, false, testAdminUser, testAdminPassword)
+	defer cleanup()
+
+	db := newTestClickhouse(t)
+	_, err := db.Initialize(context.Background(), dbplugin.InitializeRequest{
+		Config: map[string]interface{}{
+			"connection_url":        connURL,
+			"rotation_grace_period": "1h",
+		},
+		VerifyConnection: true,
+	})
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+	if !db.supportsVersion(multipleAuthVersion) {
+		t.Skipf("rotation_grace_period requires ClickHouse %d.%d or later, server is %s", multipleAuthVersion[0], multipleAuthVersion[1], db.version)
+	}
+	clock := &fakeClock{}
+	db.timerFunc = clock.afterFunc
+
+	resp, err := db.NewUser(context.Background(), dbplugin.NewUserRequest{
+		UsernameConfig: dbplugin.UsernameMetadata{DisplayName: "token", RoleName: testRole},
+		Statements: dbplugin.Statements{
+			Commands: []string{"CREATE USER '{{name}}' IDENTIFIED BY '{{password}}'"},
+		},
+		Password:   testPassword,
+		Expiration: time.Now().Add(time.Hour),
+	})
+	require.NoError(t, err)
+
+	newPassword := testPassword + "-rotated"
+	_, err = db.UpdateUser(context.Background(), dbplugin.UpdateUserRequest{
+		Username: resp.Username,
+		Password: &dbplugin.ChangePassword{NewPassword: newPassword},
+	})
+	require.NoError(t, err)
+
+	// Both passwords work during the grace period
+	require.NoError(t, clickhousehelper.TestCredsExist(t, buildTestConnURL(connURL, resp.Username, testPassword)))
+	require.NoError(t, clickhousehelper.TestCredsExist(t, buildTestConnURL(connURL, resp.Username, newPassword)))
+
+	// Only the new one is left afterwards
+	require.Len(t, clock.timers, 1)
+	clock.timers[0].f()
+	require.Error(t, clickhousehelper.TestCredsExist(t, buildTestConnURL(connURL, resp.Username, testPassword)))
+	require.NoError(t, clickhousehelper.TestCredsExist(t, buildTestConnURL(connURL, resp.Username, newPassword)))
+}
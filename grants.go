@@ -0,0 +1,49 @@
+// Copyright (c) 2024 Elaunira
+// SPDX-License-Identifier: MPL-2.0
+
+package clickhouse
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// privilegePattern matches ClickHouse privilege names such as SELECT or
+// ALTER UPDATE.
+var privilegePattern = regexp.MustCompile(`^[A-Za-z]+( [A-Za-z]+)*$`)
+
+// columnGrant describes a privilege granted on a subset of a table's columns.
+type columnGrant struct {
+	Privilege string   `json:"privilege" mapstructure:"privilege"`
+	Database  string   `json:"database" mapstructure:"database"`
+	Table     string   `json:"table" mapstructure:"table"`
+	Columns   []string `json:"columns" mapstructure:"columns"`
+}
+
+// statement returns the GRANT statement for the column grant. The grantee is
+// left as the {{name}} placeholder so it is substituted like any other
+// creation statement.
+func (g columnGrant) statement() (string, error) {
+	privilege := strings.ToUpper(strings.TrimSpace(g.Privilege))
+	if !privilegePattern.MatchString(privilege) {
+		return "", fmt.Errorf("invalid privilege %q", g.Privilege)
+	}
+	if g.Database == "" || g.Table == "" {
+		return "", fmt.Errorf("database and table are required for column grants")
+	}
+	if len(g.Columns) == 0 {
+		return "", fmt.Errorf("at least one column is required for column grants")
+	}
+
+	columns := make([]string, 0, len(g.Columns))
+	for _, col := range g.Columns {
+		if col == "" {
+			return "", fmt.Errorf("column names must not be empty")
+		}
+		columns = append(columns, quoteIdentifier(col))
+	}
+
+	return fmt.Sprintf("GRANT %s(%s) ON %s.%s TO '{{name}}'",
+		privilege, strings.Join(columns, ", "), quoteIdentifier(g.Database), quoteIdentifier(g.Table)), nil
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2024 Elaunira
+// SPDX-License-Identifier: MPL-2.0
+
+package clickhouse
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_columnGrant_statement(t *testing.T) {
+	tests := []struct {
+		name      string
+		grant     columnGrant
+		expected  string
+		expectErr bool
+	}{
+		{
+			name: "single column",
+			grant: columnGrant{
+				Privilege: "select",
+				Database:  "mydb",
+				Table:     "events",
+				Columns:   []string{"id"},
+			},
+			expected: "GRANT SELECT(`id`) ON `mydb`.`events` TO '{{name}}'",
+		},
+		{
+			name: "multiple columns",
+			grant: columnGrant{
+				Privilege: "SELECT",
+				Database:  "mydb",
+				Table:     "events",
+				Columns:   []string{"id", "created_at"},
+			},
+			expected: "GRANT SELECT(`id`, `created_at`) ON `mydb`.`events` TO '{{name}}'",
+		},
+		{
+			name: "identifiers needing escaping",
+			grant: columnGrant{
+				Privilege: "SELECT",
+				Database:  "my`db",
+				Table:     "ev;ents",
+				Columns:   []string{"we`ird"},
+			},
+			expected: "GRANT SELECT(`we\\`ird`) ON `my\\`db`.`ev;ents` TO '{{name}}'",
+		},
+		{
+			name: "invalid privilege",
+			grant: columnGrant{
+				Privilege: "SELECT; DROP",
+				Database:  "mydb",
+				Table:     "events",
+				Columns:   []string{"id"},
+			},
+			expectErr: true,
+		},
+		{
+			name: "missing columns",
+			grant: columnGrant{
+				Privilege: "SELECT",
+				Database:  "mydb",
+				Table:     "events",
+			},
+			expectErr: true,
+		},
+		{
+			name: "missing table",
+			grant: columnGrant{
+				Privilege: "SELECT",
+				Database:  "mydb",
+				Columns:   []string{"id"},
+			},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := tt.grant.statement()
+			if tt.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, result)
+		})
+	}
+}
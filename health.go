@@ -0,0 +1,133 @@
+// Copyright (c) 2024 Elaunira
+// SPDX-License-Identifier: MPL-2.0
+
+package clickhouse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// healthCheckQuery is run by HealthCheck. Unlike a driver ping it only
+// succeeds when the server is able to serve queries.
+const healthCheckQuery = "SELECT 1"
+
+// HealthCheck confirms the server can serve queries by running SELECT 1 over
+// the pooled connection, or the read_connection_url pool when one is
+// configured. Secrets are removed from the returned error. Warnings, such as
+// lagging replicas, are logged without failing the check.
+func (c *Clickhouse) HealthCheck(ctx context.Context) error {
+	status, err := c.CheckHealth(ctx)
+	for _, warning := range status.Warnings {
+		c.log().Warn("health check warning", "warning", warning)
+	}
+	return err
+}
+
+// HealthStatus is the outcome of CheckHealth.
+type HealthStatus struct {
+	// Warnings describe conditions worth attention that don't make the server
+	// unhealthy.
+	Warnings []string
+}
+
+// CheckHealth is HealthCheck, returning warnings instead of logging them.
+// With max_replication_lag set, replicated tables on the server users are
+// created on that are further behind are reported as warnings.
+func (c *Clickhouse) CheckHealth(ctx context.Context) (HealthStatus, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	db, err := c.readConnection(ctx)
+	if err != nil {
+		return HealthStatus{}, fmt.Errorf("health check failed: %w", c.sanitizeError(err))
+	}
+
+	var result uint8
+	if err := db.QueryRowContext(ctx, healthCheckQuery).Scan(&result); err != nil {
+		return HealthStatus{}, fmt.Errorf("health check failed: %w", c.sanitizeError(err))
+	}
+
+	var status HealthStatus
+	if c.MaxReplicationLag > 0 {
+		replicas, err := c.replicaStatuses(ctx)
+		if err != nil {
+			status.Warnings = append(status.Warnings, fmt.Sprintf("replication status unavailable: %s", c.sanitizeError(err)))
+		} else {
+			status.Warnings = append(status.Warnings, laggingReplicas(replicas, c.MaxReplicationLag)...)
+		}
+	}
+
+	return status, nil
+}
+
+// replicaStatus is a row of system.replicas.
+type replicaStatus struct {
+	Database string
+	Table    string
+	// Delay is how far the replica is behind, from absolute_delay.
+	Delay time.Duration
+}
+
+// replicaStatusQuery lists the replicated tables with their delay. A server
+// without replicated tables returns no rows.
+const replicaStatusQuery = "SELECT database, table, absolute_delay FROM system.replicas ORDER BY database, table"
+
+// replicaStatuses returns the replication status of the tables on the
+// primary connection, where users are created. The caller must hold the lock.
+func (c *Clickhouse) replicaStatuses(ctx context.Context) ([]replicaStatus, error) {
+	db, err := c.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, replicaStatusQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query system.replicas: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var replicas []replicaStatus
+	for rows.Next() {
+		var (
+			r     replicaStatus
+			delay uint64
+		)
+		if err := rows.Scan(&r.Database, &r.Table, &delay); err != nil {
+			return nil, fmt.Errorf("failed to read replica status: %w", err)
+		}
+		r.Delay = time.Duration(delay) * time.Second
+		replicas = append(replicas, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query system.replicas: %w", err)
+	}
+
+	return replicas, nil
+}
+
+// laggingReplicas returns a warning for each replica further behind than
+// threshold.
+func laggingReplicas(replicas []replicaStatus, threshold time.Duration) []string {
+	var warnings []string
+	for _, r := range replicas {
+		if r.Delay > threshold {
+			warnings = append(warnings, fmt.Sprintf("replica %s.%s is %s behind (threshold %s)", r.Database, r.Table, r.Delay, threshold))
+		}
+	}
+	return warnings
+}
+
+// sanitizeError replaces any secret values in err's message with their
+// placeholders. Errors without secrets are returned unchanged, so they can
+// still be matched with errors.Is.
+func (c *Clickhouse) sanitizeError(err error) error {
+	original := err.Error()
+	msg := maskSecrets(original, c.SecretValues())
+	if msg == original {
+		return err
+	}
+	return errors.New(msg)
+}
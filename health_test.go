@@ -0,0 +1,118 @@
+// Copyright (c) 2024 Elaunira
+// SPDX-License-Identifier: MPL-2.0
+
+package clickhouse
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	clickhousehelper "github.com/elaunira/openbao-plugin-database-clickhouse/testhelpers/clickhouse"
+	"github.com/openbao/openbao/sdk/v2/database/dbplugin/v5"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClickhouse_HealthCheck(t *testing.T) {
+	cleanup, connURL := clickhousehelper.PrepareTestContainer(t, false, testAdminUser, testAdminPassword)
+	defer cleanup()
+
+	db := newTestClickhouse(t)
+	_, err := db.Initialize(context.Background(), dbplugin.InitializeRequest{
+		Config: map[string]interface{}{
+			"connection_url": connURL,
+		},
+		VerifyConnection: true,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, db.HealthCheck(context.Background()))
+
+	require.NoError(t, db.Close())
+	err = db.HealthCheck(context.Background())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "health check failed")
+}
+
+func TestClickhouse_HealthCheck_ReadConnectionURL(t *testing.T) {
+	cleanup, connURL := clickhousehelper.PrepareTestContainer(t, false, testAdminUser, testAdminPassword)
+	defer cleanup()
+
+	// The read URL can't authenticate, so only queries sent to it fail
+	db := newTestClickhouse(t)
+	_, err := db.Initialize(context.Background(), dbplugin.InitializeRequest{
+		Config: map[string]interface{}{
+			"connection_url":      connURL,
+			"read_connection_url": buildTestConnURL(connURL, testAdminUser, "wrong-password"),
+		},
+	})
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+
+	err = db.HealthCheck(context.Background())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "health check failed")
+
+	_, err = db.NewUser(context.Background(), dbplugin.NewUserRequest{
+		UsernameConfig: dbplugin.UsernameMetadata{DisplayName: "token", RoleName: testRole},
+		Statements: dbplugin.Statements{
+			Commands: []string{"CREATE USER '{{name}}' IDENTIFIED BY '{{password}}'"},
+		},
+		Password:   testPassword,
+		Expiration: time.Now().Add(time.Hour),
+	})
+	require.NoError(t, err)
+}
+
+func TestClickhouse_HealthCheck_NotInitialized(t *testing.T) {
+	db := newTestClickhouse(t)
+	err := db.HealthCheck(context.Background())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not initialized")
+}
+
+func TestClickhouse_sanitizeError(t *testing.T) {
+	db := newTestClickhouse(t)
+	db.Password = "s3cr3t"
+
+	err := db.sanitizeError(errors.New("auth failed for admin:s3cr3t"))
+	require.Equal(t, "auth failed for admin:[password]", err.Error())
+}
+
+func Test_laggingReplicas(t *testing.T) {
+	replicas := []replicaStatus{
+		{Database: "analytics", Table: "events", Delay: 2 * time.Minute},
+		{Database: "analytics", Table: "users", Delay: 5 * time.Second},
+		{Database: "billing", Table: "invoices", Delay: 30 * time.Second},
+	}
+
+	require.Equal(t, []string{
+		"replica analytics.events is 2m0s behind (threshold 30s)",
+	}, laggingReplicas(replicas, 30*time.Second))
+	require.Len(t, laggingReplicas(replicas, time.Second), 3)
+
+	// Servers without replicated tables have nothing to report
+	require.Empty(t, laggingReplicas(nil, 30*time.Second))
+}
+
+func TestClickhouse_CheckHealth_MaxReplicationLag(t *testing.T) {
+	cleanup, connURL := clickhousehelper.PrepareTestContainer(t, false, testAdminUser, testAdminPassword)
+	defer cleanup()
+
+	db := newTestClickhouse(t)
+	_, err := db.Initialize(context.Background(), dbplugin.InitializeRequest{
+		Config: map[string]interface{}{
+			"connection_url":      connURL,
+			"max_replication_lag": "30s",
+		},
+		VerifyConnection: true,
+	})
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+
+	// A single node has no replicated tables, so nothing is reported
+	status, err := db.CheckHealth(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, status.Warnings)
+}
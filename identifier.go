@@ -0,0 +1,164 @@
+// Copyright (c) 2024 Elaunira
+// SPDX-License-Identifier: MPL-2.0
+
+package clickhouse
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// safeIdentifierPattern matches names that can be substituted into statements
+// without quoting.
+var safeIdentifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// validateIdentifier returns an error if name is not a safe identifier. An
+// empty name is accepted so optional settings can be left unset.
+func validateIdentifier(kind, name string) error {
+	if name == "" || safeIdentifierPattern.MatchString(name) {
+		return nil
+	}
+	return fmt.Errorf("%s %q is not a valid identifier", kind, name)
+}
+
+// quoteIdentifier wraps an identifier in backticks, escaping backslashes and
+// backticks contained in the name.
+func quoteIdentifier(name string) string {
+	name = strings.ReplaceAll(name, `\`, `\\`)
+	name = strings.ReplaceAll(name, "`", "\\`")
+	return "`" + name + "`"
+}
+
+// maxUsernameLength is the longest username the plugin generates. ClickHouse
+// itself accepts longer names, but they are awkward in logs, grants and
+// external tooling matching on the name.
+const maxUsernameLength = 64
+
+// validateUsername returns an error if name is not usable as a generated
+// username. ClickHouse accepts most names when quoted, but whitespace, control
+// characters, quotes and backslashes break statements that reference the name
+// without escaping it.
+func validateUsername(name string) error {
+	if name == "" {
+		return fmt.Errorf("username must not be empty")
+	}
+	if len(name) > maxUsernameLength {
+		return fmt.Errorf("username %q is longer than %d characters", name, maxUsernameLength)
+	}
+	return validateUsernameChars(name)
+}
+
+// validateUsernameChars returns an error if name contains a character that
+// validateUsername rejects. It also applies to the username_prefix and
+// username_suffix.
+func validateUsernameChars(name string) error {
+	for _, r := range name {
+		if unicode.IsSpace(r) || unicode.IsControl(r) || strings.ContainsRune("'\"`\\", r) {
+			return fmt.Errorf("username %q contains invalid character %q", name, r)
+		}
+	}
+	return nil
+}
+
+// Username case normalizations accepted by username_case.
+const (
+	usernameCasePreserve = "preserve"
+	usernameCaseLower    = "lower"
+	usernameCaseUpper    = "upper"
+)
+
+var usernameCases = []string{usernameCasePreserve, usernameCaseLower, usernameCaseUpper}
+
+// validateUsernameCase returns an error if mode is not a supported
+// username_case. An empty mode preserves the case.
+func validateUsernameCase(mode string) error {
+	if mode == "" || slices.Contains(usernameCases, mode) {
+		return nil
+	}
+	return fmt.Errorf("invalid username_case %q: must be one of %s", mode, strings.Join(usernameCases, ", "))
+}
+
+// applyUsernameCase normalizes the case of a generated username according to
+// mode.
+func applyUsernameCase(mode, name string) string {
+	switch mode {
+	case usernameCaseLower:
+		return strings.ToLower(name)
+	case usernameCaseUpper:
+		return strings.ToUpper(name)
+	default:
+		return name
+	}
+}
+
+// Identifier quoting styles accepted by identifier_quote.
+const (
+	identifierQuoteSingle   = "single"
+	identifierQuoteBacktick = "backtick"
+	identifierQuoteDouble   = "double"
+)
+
+var identifierQuotes = map[string]string{
+	identifierQuoteSingle:   "'",
+	identifierQuoteBacktick: "`",
+	identifierQuoteDouble:   `"`,
+}
+
+// validateIdentifierQuote returns an error if style is not a supported
+// identifier_quote. An empty style uses single quotes.
+func validateIdentifierQuote(style string) error {
+	if _, ok := identifierQuotes[style]; ok || style == "" {
+		return nil
+	}
+	return fmt.Errorf("invalid identifier_quote %q: must be one of %s, %s, %s",
+		style, identifierQuoteSingle, identifierQuoteBacktick, identifierQuoteDouble)
+}
+
+// identifierQuoteChar returns the quote character of style, defaulting to a
+// single quote.
+func identifierQuoteChar(style string) string {
+	if q, ok := identifierQuotes[style]; ok {
+		return q
+	}
+	return "'"
+}
+
+// quoteName quotes the name of a user, role or settings profile in the given
+// identifier_quote style, escaping backslashes and the quote character.
+// ClickHouse accepts these names as string literals as well as identifiers,
+// unlike database and table names, which quoteIdentifier quotes.
+func quoteName(name, style string) string {
+	q := identifierQuoteChar(style)
+	name = strings.ReplaceAll(name, `\`, `\\`)
+	name = strings.ReplaceAll(name, q, `\`+q)
+	return q + name + q
+}
+
+// requoteNames rewrites the single-quoted {{name}} and {{new_username}}
+// placeholders of a built-in statement to the given identifier_quote style.
+// Statements supplied by roles are never rewritten.
+func requoteNames(statement, style string) string {
+	q := identifierQuoteChar(style)
+	if q == "'" {
+		return statement
+	}
+	for _, placeholder := range []string{"{{name}}", "{{new_username}}"} {
+		statement = strings.ReplaceAll(statement, "'"+placeholder+"'", q+placeholder+q)
+	}
+	return statement
+}
+
+// escapeValue escapes s for substitution into a statement: for a
+// single-quoted string literal, and also for an identifier quoted in the
+// given style. ClickHouse decodes a backslash followed by any other character
+// to that character, so the extra escaping is harmless in string literals.
+func escapeValue(s, style string) string {
+	s = escapeClickHouseString(s)
+	if q := identifierQuoteChar(style); q != "'" {
+		s = strings.ReplaceAll(s, q, `\`+q)
+	}
+	return s
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2024 Elaunira
+// SPDX-License-Identifier: MPL-2.0
+
+package clickhouse
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_validateIdentifier(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		expectErr bool
+	}{
+		{name: "empty", input: ""},
+		{name: "simple", input: "analytics"},
+		{name: "underscore and digits", input: "_db_2024"},
+		{name: "leading digit", input: "1db", expectErr: true},
+		{name: "quote", input: "db'", expectErr: true},
+		{name: "space", input: "my db", expectErr: true},
+		{name: "semicolon", input: "db;DROP", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateIdentifier("database", tt.input)
+			if tt.expectErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func Test_quoteIdentifier(t *testing.T) {
+	require.Equal(t, "`events`", quoteIdentifier("events"))
+	require.Equal(t, "`we\\`ird`", quoteIdentifier("we`ird"))
+	require.Equal(t, "`back\\\\slash`", quoteIdentifier(`back\slash`))
+}
+
+func Test_quoteName(t *testing.T) {
+	require.Equal(t, "'reader'", quoteName("reader", ""))
+	require.Equal(t, `'o\'brien'`, quoteName("o'brien", identifierQuoteSingle))
+	require.Equal(t, "`we\\`ird`", quoteName("we`ird", identifierQuoteBacktick))
+	require.Equal(t, `"back\\slash"`, quoteName(`back\slash`, identifierQuoteDouble))
+}
+
+func Test_validateUsername(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		expectErr bool
+	}{
+		{name: "default template output", input: "v-token-role-AbCdEf123456789-1700000000"},
+		{name: "email", input: "alice@example.com"},
+		{name: "empty", input: "", expectErr: true},
+		{name: "space", input: "v token", expectErr: true},
+		{name: "newline", input: "v-token\n", expectErr: true},
+		{name: "quote", input: "v-o'brien", expectErr: true},
+		{name: "backtick", input: "v-`token`", expectErr: true},
+		{name: "backslash", input: `v-token\`, expectErr: true},
+		{name: "too long", input: strings.Repeat("a", maxUsernameLength+1), expectErr: true},
+		{name: "longest", input: strings.Repeat("a", maxUsernameLength)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateUsername(tt.input)
+			if tt.expectErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func Test_applyUsernameCase(t *testing.T) {
+	require.Equal(t, "v-Token-AbC", applyUsernameCase(usernameCasePreserve, "v-Token-AbC"))
+	require.Equal(t, "v-Token-AbC", applyUsernameCase("", "v-Token-AbC"))
+	require.Equal(t, "v-token-abc", applyUsernameCase(usernameCaseLower, "v-Token-AbC"))
+	require.Equal(t, "V-TOKEN-ABC", applyUsernameCase(usernameCaseUpper, "v-Token-AbC"))
+
+	require.NoError(t, validateUsernameCase(""))
+	require.Error(t, validateUsernameCase("Lower"))
+}
+
+func Test_requoteNames(t *testing.T) {
+	require.Equal(t, defaultRevocationStatement, requoteNames(defaultRevocationStatement, identifierQuoteSingle))
+	require.Equal(t, "DROP USER IF EXISTS `{{name}}`", requoteNames(defaultRevocationStatement, identifierQuoteBacktick))
+	require.Equal(t, `ALTER USER "{{name}}" RENAME TO "{{new_username}}"`, requoteNames(defaultRenameStatement, identifierQuoteDouble))
+
+	// Only the name is an identifier; the password stays a string literal
+	require.Equal(t, "ALTER USER IF EXISTS `{{name}}` IDENTIFIED BY '{{password}}'",
+		requoteNames(defaultRotateCredentialsStatement, identifierQuoteBacktick))
+}
+
+func Test_validateIdentifierQuote(t *testing.T) {
+	for _, style := range []string{"", identifierQuoteSingle, identifierQuoteBacktick, identifierQuoteDouble} {
+		require.NoError(t, validateIdentifierQuote(style))
+	}
+	require.ErrorContains(t, validateIdentifierQuote("bracket"), `invalid identifier_quote "bracket"`)
+}
+
+func TestClickhouse_IdentifierQuote(t *testing.T) {
+	const username = "v-o'brien`\"x"
+
+	tests := []struct {
+		style    string
+		expected []string
+	}{
+		{
+			style: identifierQuoteSingle,
+			expected: []string{
+				`REVOKE ALL PRIVILEGES ON *.* FROM 'v-o\'brien` + "`" + `"x'`,
+				`DROP USER IF EXISTS 'v-o\'brien` + "`" + `"x'`,
+			},
+		},
+		{
+			style: identifierQuoteBacktick,
+			expected: []string{
+				"REVOKE ALL PRIVILEGES ON *.* FROM `v-o\\'brien\\`\"x`",
+				"DROP USER IF EXISTS `v-o\\'brien\\`\"x`",
+			},
+		},
+		{
+			style: identifierQuoteDouble,
+			expected: []string{
+				`REVOKE ALL PRIVILEGES ON *.* FROM "v-o\'brien` + "`" + `\"x"`,
+				`DROP USER IF EXISTS "v-o\'brien` + "`" + `\"x"`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.style, func(t *testing.T) {
+			db := newTestClickhouse(t)
+			require.NoError(t, db.Init(context.Background(), map[string]interface{}{
+				"connection_url":   "clickhouse://localhost:9000",
+				"identifier_quote": tt.style,
+			}, false))
+
+			fake := &recordingExecer{}
+			statements := deletionStatements(nil, revokeAllStatements(nil, db.IdentifierQuote), db.defaultDropStatement())
+			require.NoError(t, db.executeDeletion(context.Background(), fake, username, statements))
+			require.Equal(t, tt.expected, fake.queries)
+		})
+	}
+
+	err := newTestClickhouse(t).Init(context.Background(), map[string]interface{}{
+		"connection_url":   "clickhouse://localhost:9000",
+		"identifier_quote": "bracket",
+	}, false)
+	require.ErrorContains(t, err, "invalid identifier_quote")
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2024 Elaunira
+// SPDX-License-Identifier: MPL-2.0
+
+package clickhouse
+
+import (
+	"context"
+	"time"
+)
+
+// startKeepAlive starts a background goroutine pinging the open pools every
+// interval, so idle connections are not silently dropped by the network. The
+// caller must hold the lock.
+func (c *clickhouseConnectionProducer) startKeepAlive(interval time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	c.stopKeepAlive = cancel
+	c.keepAliveDone = done
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			// A busy producer is using its connections anyway. Never blocking
+			// on the lock also lets Close wait for this goroutine while
+			// holding it.
+			if !c.TryLock() {
+				continue
+			}
+			c.keepAlive(ctx, interval)
+			c.Unlock()
+		}
+	}()
+}
+
+// keepAlive pings the pools opened so far, replacing any that went stale. It
+// never opens a pool that wasn't needed yet. The caller must hold the lock.
+func (c *clickhouseConnectionProducer) keepAlive(ctx context.Context, timeout time.Duration) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// The pools are pinged even with skip_connection_ping, which only
+	// concerns the requests
+	if c.db != nil {
+		if _, err := c.pool(ctx, &c.db, c.ConnectionURL, true); err != nil {
+			c.log().Warn("keep-alive ping failed", "error", err)
+		}
+	}
+	if c.readDB != nil && c.ReadConnectionURL != "" {
+		if _, err := c.pool(ctx, &c.readDB, c.ReadConnectionURL, true); err != nil {
+			c.log().Warn("keep-alive ping of read connection failed", "error", err)
+		}
+	}
+}
+
+// stopKeepAliveLoop stops the keep-alive goroutine, if any, and waits for it
+// to exit. The caller must hold the lock.
+func (c *clickhouseConnectionProducer) stopKeepAliveLoop() {
+	if c.stopKeepAlive == nil {
+		return
+	}
+	c.stopKeepAlive()
+	<-c.keepAliveDone
+	c.stopKeepAlive = nil
+	c.keepAliveDone = nil
+}
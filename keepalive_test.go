@@ -0,0 +1,81 @@
+// Copyright (c) 2024 Elaunira
+// SPDX-License-Identifier: MPL-2.0
+
+package clickhouse
+
+import (
+	"context"
+	"database/sql"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_clickhouseConnectionProducer_KeepAlive(t *testing.T) {
+	var pings atomic.Int32
+	c := &clickhouseConnectionProducer{
+		ping: func(context.Context, *sql.DB) error {
+			pings.Add(1)
+			return nil
+		},
+	}
+	require.NoError(t, c.Init(context.Background(), map[string]interface{}{
+		"connection_url":      "clickhouse://localhost:9000",
+		"keep_alive_interval": "10ms",
+	}, true))
+	done := c.keepAliveDone
+	require.NotNil(t, done)
+
+	// The pool opened by the verification is pinged in the background
+	verified := pings.Load()
+	require.Eventually(t, func() bool { return pings.Load() >= verified+2 }, 5*time.Second, 5*time.Millisecond)
+
+	c.Lock()
+	require.NoError(t, c.Close())
+	c.Unlock()
+
+	// Close waited for the goroutine to exit
+	select {
+	case <-done:
+	default:
+		t.Fatal("keep-alive goroutine still running after Close")
+	}
+	stopped := pings.Load()
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, stopped, pings.Load())
+}
+
+func Test_clickhouseConnectionProducer_KeepAlive_NoPool(t *testing.T) {
+	var pings atomic.Int32
+	c := &clickhouseConnectionProducer{
+		ping: func(context.Context, *sql.DB) error {
+			pings.Add(1)
+			return nil
+		},
+	}
+	require.NoError(t, c.Init(context.Background(), map[string]interface{}{
+		"connection_url":      "clickhouse://localhost:9000",
+		"keep_alive_interval": "10ms",
+	}, false))
+
+	// Without a pool there is nothing to keep alive, and none is opened
+	time.Sleep(50 * time.Millisecond)
+	require.Zero(t, pings.Load())
+	require.Nil(t, c.db)
+
+	// Init restarts the keep-alive with the new configuration
+	require.NoError(t, c.Init(context.Background(), map[string]interface{}{
+		"connection_url":      "clickhouse://localhost:9000",
+		"keep_alive_interval": "0",
+	}, false))
+	require.Nil(t, c.stopKeepAlive)
+	require.NoError(t, c.Close())
+
+	err := c.Init(context.Background(), map[string]interface{}{
+		"connection_url":      "clickhouse://localhost:9000",
+		"keep_alive_interval": "-1s",
+	}, false)
+	require.ErrorContains(t, err, "keep_alive_interval must not be negative")
+}
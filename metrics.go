@@ -0,0 +1,67 @@
+// Copyright (c) 2024 Elaunira
+// SPDX-License-Identifier: MPL-2.0
+
+package clickhouse
+
+import (
+	"database/sql"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+)
+
+// newMetrics returns a metrics instance prefixed with the plugin type that
+// emits to sink. Runtime and hostname metrics are left to the host process.
+func newMetrics(sink metrics.MetricSink) (*metrics.Metrics, error) {
+	conf := metrics.DefaultConfig(clickhouseTypeName)
+	conf.EnableHostname = false
+	conf.EnableRuntimeMetrics = false
+	return metrics.New(conf, sink)
+}
+
+// WithMetrics sets the sink receiving operation timings and counters. By
+// default metrics are discarded.
+func (c *Clickhouse) WithMetrics(sink metrics.MetricSink) error {
+	m, err := newMetrics(sink)
+	if err != nil {
+		return err
+	}
+	c.metrics = m
+	return nil
+}
+
+// recordOperation emits the latency of operation and increments its success
+// or error counter, keyed as clickhouse.<operation>[.success|.error].
+func (c *Clickhouse) recordOperation(operation string, start time.Time, err error) {
+	if c.metrics == nil {
+		return
+	}
+
+	c.metrics.MeasureSince([]string{operation}, start)
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	c.metrics.IncrCounter([]string{operation, outcome}, 1)
+}
+
+// CollectMetrics returns gauges describing the primary connection pool, keyed
+// by name, for export to a metrics system such as Prometheus. All gauges are
+// zero while no pool is open; collecting them never opens one.
+func (c *clickhouseConnectionProducer) CollectMetrics() map[string]float64 {
+	c.Lock()
+	defer c.Unlock()
+
+	var stats sql.DBStats
+	if c.db != nil {
+		stats = c.db.Stats()
+	}
+
+	return map[string]float64{
+		"open_connections":      float64(stats.OpenConnections),
+		"in_use":                float64(stats.InUse),
+		"idle":                  float64(stats.Idle),
+		"wait_count":            float64(stats.WaitCount),
+		"wait_duration_seconds": stats.WaitDuration.Seconds(),
+	}
+}
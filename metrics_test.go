@@ -0,0 +1,94 @@
+// Copyright (c) 2024 Elaunira
+// SPDX-License-Identifier: MPL-2.0
+
+package clickhouse
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	clickhousehelper "github.com/elaunira/openbao-plugin-database-clickhouse/testhelpers/clickhouse"
+	"github.com/openbao/openbao/sdk/v2/database/dbplugin/v5"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClickhouse_WithMetrics(t *testing.T) {
+	db := newTestClickhouse(t)
+	sink := metrics.NewInmemSink(time.Minute, time.Hour)
+	require.NoError(t, db.WithMetrics(sink))
+
+	_, err := db.NewUser(context.Background(), dbplugin.NewUserRequest{
+		UsernameConfig: dbplugin.UsernameMetadata{DisplayName: "token", RoleName: testRole},
+		Password:       testPassword,
+		Expiration:     time.Now().Add(time.Hour),
+	})
+	require.ErrorIs(t, err, ErrNoCreationStatements)
+
+	data := sink.Data()
+	require.NotEmpty(t, data)
+	require.Contains(t, data[0].Samples, "clickhouse.NewUser")
+	require.Equal(t, 1, data[0].Samples["clickhouse.NewUser"].Count)
+	require.Contains(t, data[0].Counters, "clickhouse.NewUser.error")
+	require.NotContains(t, data[0].Counters, "clickhouse.NewUser.success")
+}
+
+func TestClickhouse_recordOperation_NoMetrics(t *testing.T) {
+	db := newTestClickhouse(t)
+	require.NotPanics(t, func() {
+		db.recordOperation("NewUser", time.Now(), nil)
+	})
+}
+
+var metricNames = []string{"open_connections", "in_use", "idle", "wait_count", "wait_duration_seconds"}
+
+func Test_clickhouseConnectionProducer_CollectMetrics_NoPool(t *testing.T) {
+	c := &clickhouseConnectionProducer{
+		ping: func(context.Context, *sql.DB) error { return nil },
+	}
+	require.NoError(t, c.Init(context.Background(), map[string]interface{}{
+		"connection_url": "clickhouse://localhost:9000",
+	}, false))
+
+	gauges := c.CollectMetrics()
+	require.Len(t, gauges, len(metricNames))
+	for _, name := range metricNames {
+		require.Contains(t, gauges, name)
+		require.Zero(t, gauges[name])
+	}
+
+	// Collecting doesn't open a pool
+	require.Nil(t, c.db)
+}
+
+func TestClickhouse_CollectMetrics(t *testing.T) {
+	cleanup, connURL := clickhousehelper.PrepareTestContainer(t, false, testAdminUser, testAdminPassword)
+	defer cleanup()
+
+	db := newTestClickhouse(t)
+	_, err := db.Initialize(context.Background(), dbplugin.InitializeRequest{
+		Config: map[string]interface{}{
+			"connection_url": connURL,
+		},
+		VerifyConnection: true,
+	})
+	require.NoError(t, err)
+	defer db.Close()
+
+	pool, err := db.Connection(context.Background())
+	require.NoError(t, err)
+	conn, err := pool.Conn(context.Background())
+	require.NoError(t, err)
+
+	gauges := db.CollectMetrics()
+	require.Len(t, gauges, len(metricNames))
+	require.GreaterOrEqual(t, gauges["open_connections"], float64(1))
+	require.Equal(t, float64(1), gauges["in_use"])
+
+	require.NoError(t, conn.Close())
+	gauges = db.CollectMetrics()
+	require.Zero(t, gauges["in_use"])
+	require.GreaterOrEqual(t, gauges["idle"], float64(1))
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2024 Elaunira
+// SPDX-License-Identifier: MPL-2.0
+
+package clickhouse
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+const (
+	defaultPasswordLength = 24
+
+	passwordLowerChars = "abcdefghijklmnopqrstuvwxyz"
+	passwordUpperChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	passwordDigitChars = "0123456789"
+	// Quotes, backticks, backslashes and semicolons are left out so generated
+	// passwords can be substituted into ClickHouse statements verbatim.
+	passwordSymbolChars = "!#$%&()*+,-./:<=>?@[]^_{|}~"
+)
+
+// Handling of quotes in passwords accepted by password_quote_mode. Passwords
+// are substituted into string literals such as '{{password}}': escape
+// escapes quotes and backslashes so the literal stays intact, reject refuses
+// such passwords instead.
+const (
+	passwordQuoteEscape = "escape"
+	passwordQuoteReject = "reject"
+)
+
+// passwordQuoteChars are the characters that would end or alter a quoted
+// password literal unless escaped.
+const passwordQuoteChars = `'\`
+
+// checkPasswordQuotes returns ErrPasswordQuotes if mode is reject and the
+// password contains one of the passwordQuoteChars.
+func checkPasswordQuotes(mode, password string) error {
+	if mode == passwordQuoteReject && strings.ContainsAny(password, passwordQuoteChars) {
+		return fmt.Errorf("%w; set password_quote_mode to %q to escape them", ErrPasswordQuotes, passwordQuoteEscape)
+	}
+	return nil
+}
+
+// passwordPolicy controls the passwords generated by the plugin itself, e.g.
+// when rotating the root credential.
+type passwordPolicy struct {
+	Length         int  `json:"length" mapstructure:"length"`
+	RequireSymbols bool `json:"require_symbols" mapstructure:"require_symbols"`
+}
+
+// generate returns a new password following the policy.
+func (p passwordPolicy) generate() (string, error) {
+	length := p.Length
+	if length == 0 {
+		length = defaultPasswordLength
+	}
+
+	return generatePassword(length, p.RequireSymbols)
+}
+
+// generatePassword returns a random password of the given length containing
+// at least one lowercase letter, uppercase letter and digit, plus at least one
+// symbol when requireSymbols is set.
+func generatePassword(length int, requireSymbols bool) (string, error) {
+	classes := []string{passwordLowerChars, passwordUpperChars, passwordDigitChars}
+	if requireSymbols {
+		classes = append(classes, passwordSymbolChars)
+	}
+
+	if length < len(classes) {
+		return "", fmt.Errorf("password length must be at least %d", len(classes))
+	}
+
+	var alphabet string
+	for _, class := range classes {
+		alphabet += class
+	}
+
+	password := make([]byte, 0, length)
+
+	// Guarantee one character from every required class
+	for _, class := range classes {
+		ch, err := randomChar(class)
+		if err != nil {
+			return "", err
+		}
+		password = append(password, ch)
+	}
+
+	for len(password) < length {
+		ch, err := randomChar(alphabet)
+		if err != nil {
+			return "", err
+		}
+		password = append(password, ch)
+	}
+
+	// Shuffle so the guaranteed characters are not always at the front
+	for i := len(password) - 1; i > 0; i-- {
+		j, err := randomInt(i + 1)
+		if err != nil {
+			return "", err
+		}
+		password[i], password[j] = password[j], password[i]
+	}
+
+	return string(password), nil
+}
+
+func randomChar(chars string) (byte, error) {
+	i, err := randomInt(len(chars))
+	if err != nil {
+		return 0, err
+	}
+	return chars[i], nil
+}
+
+func randomInt(n int) (int, error) {
+	v, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0, fmt.Errorf("failed to generate random number: %w", err)
+	}
+	return int(v.Int64()), nil
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2024 Elaunira
+// SPDX-License-Identifier: MPL-2.0
+
+package clickhouse
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openbao/openbao/sdk/v2/database/dbplugin/v5"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_generatePassword(t *testing.T) {
+	tests := []struct {
+		name           string
+		length         int
+		requireSymbols bool
+		expectErr      bool
+	}{
+		{
+			name:   "alphanumeric",
+			length: 16,
+		},
+		{
+			name:           "with symbols",
+			length:         32,
+			requireSymbols: true,
+		},
+		{
+			name:           "minimum length with symbols",
+			length:         4,
+			requireSymbols: true,
+		},
+		{
+			name:           "too short for required classes",
+			length:         3,
+			requireSymbols: true,
+			expectErr:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 50; i++ {
+				password, err := generatePassword(tt.length, tt.requireSymbols)
+				if tt.expectErr {
+					require.Error(t, err)
+					return
+				}
+				require.NoError(t, err)
+				require.Len(t, password, tt.length)
+				require.True(t, strings.ContainsAny(password, passwordLowerChars))
+				require.True(t, strings.ContainsAny(password, passwordUpperChars))
+				require.True(t, strings.ContainsAny(password, passwordDigitChars))
+				require.Equal(t, tt.requireSymbols, strings.ContainsAny(password, passwordSymbolChars))
+				require.False(t, strings.ContainsAny(password, "'\\\"`;"))
+			}
+		})
+	}
+}
+
+func Test_passwordPolicy_generate(t *testing.T) {
+	password, err := passwordPolicy{}.generate()
+	require.NoError(t, err)
+	require.Len(t, password, defaultPasswordLength)
+
+	c := &clickhouseConnectionProducer{}
+	err = c.Init(context.Background(), map[string]interface{}{
+		"host": "localhost",
+		"port": 9000,
+		"generated_password_policy": map[string]interface{}{
+			"length":          40,
+			"require_symbols": true,
+		},
+	}, false)
+	require.NoError(t, err)
+
+	password, err = c.GeneratedPasswordPolicy.generate()
+	require.NoError(t, err)
+	require.Len(t, password, 40)
+	require.True(t, strings.ContainsAny(password, passwordSymbolChars))
+}
+
+func Test_checkPasswordQuotes(t *testing.T) {
+	require.NoError(t, checkPasswordQuotes(passwordQuoteEscape, `it's\`))
+	require.NoError(t, checkPasswordQuotes(passwordQuoteReject, "plain-pass"))
+	require.ErrorIs(t, checkPasswordQuotes(passwordQuoteReject, "it's"), ErrPasswordQuotes)
+	require.ErrorIs(t, checkPasswordQuotes(passwordQuoteReject, `back\slash`), ErrPasswordQuotes)
+}
+
+func TestClickhouse_PasswordQuoteMode(t *testing.T) {
+	const password = "it's-a-pass"
+	req := dbplugin.NewUserRequest{
+		UsernameConfig: dbplugin.UsernameMetadata{DisplayName: "token", RoleName: testRole},
+		Statements: dbplugin.Statements{
+			Commands: []string{"CREATE USER '{{name}}' IDENTIFIED BY '{{password}}'"},
+		},
+		Password:   password,
+		Expiration: time.Now().Add(time.Hour),
+	}
+
+	// By default the quote is escaped and the literal stays intact
+	db := newTestClickhouse(t)
+	require.NoError(t, db.Init(context.Background(), map[string]interface{}{
+		"connection_url": "clickhouse://localhost:9000",
+	}, false))
+	require.Equal(t, passwordQuoteEscape, db.PasswordQuoteMode)
+	username, statements, values, err := db.creationPlan(req)
+	require.NoError(t, err)
+	queries, err := db.renderStatements(statements, values)
+	require.NoError(t, err)
+	require.Equal(t, []string{"CREATE USER '" + username + `' IDENTIFIED BY 'it\'s-a-pass'`}, queries)
+
+	// In reject mode the password is refused before anything runs
+	db = newTestClickhouse(t)
+	require.NoError(t, db.Init(context.Background(), map[string]interface{}{
+		"connection_url":      "clickhouse://localhost:9000",
+		"password_quote_mode": passwordQuoteReject,
+	}, false))
+	_, err = db.NewUser(context.Background(), req)
+	require.ErrorIs(t, err, ErrPasswordQuotes)
+	require.NotContains(t, err.Error(), password)
+	require.Nil(t, db.db)
+
+	_, err = db.UpdateUser(context.Background(), dbplugin.UpdateUserRequest{
+		Username: "v-token",
+		Password: &dbplugin.ChangePassword{NewPassword: password},
+	})
+	require.ErrorIs(t, err, ErrPasswordQuotes)
+
+	err = newTestClickhouse(t).Init(context.Background(), map[string]interface{}{
+		"connection_url":      "clickhouse://localhost:9000",
+		"password_quote_mode": "strip",
+	}, false)
+	require.ErrorContains(t, err, "invalid password_quote_mode")
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2024 Elaunira
+// SPDX-License-Identifier: MPL-2.0
+
+package clickhouse
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/openbao/openbao/sdk/v2/database/dbplugin/v5"
+)
+
+// RotationResult is the outcome of rotating the password of a single user.
+// NewPassword is only set on success and is redacted when the result is
+// formatted, so results can be logged safely.
+type RotationResult struct {
+	Username    string
+	Success     bool
+	Err         error
+	NewPassword string
+}
+
+// String implements fmt.Stringer without exposing the new password.
+func (r RotationResult) String() string {
+	password := ""
+	if r.NewPassword != "" {
+		password = "[redacted]"
+	}
+	return fmt.Sprintf("{Username:%s Success:%t Err:%v NewPassword:%s}", r.Username, r.Success, r.Err, password)
+}
+
+// GoString implements fmt.GoStringer so %#v does not expose the new password.
+func (r RotationResult) GoString() string {
+	return "clickhouse.RotationResult" + r.String()
+}
+
+// RotateUsers generates a new password for each user according to the
+// generated_password_policy and applies it with the given statements, or the
+// default rotation statement when none are provided. A failure for one user
+// does not stop the rotation of the others. Rotating the admin user stops at
+// its first failing statement, and once it succeeded the plugin reconnects
+// with the new password, as UpdateUser does.
+func (c *Clickhouse) RotateUsers(ctx context.Context, usernames, statements []string) []RotationResult {
+	c.Lock()
+	defer c.Unlock()
+
+	results := make([]RotationResult, 0, len(usernames))
+	for _, username := range usernames {
+		result := RotationResult{Username: username}
+
+		password, err := c.GeneratedPasswordPolicy.generate()
+		if err != nil {
+			result.Err = fmt.Errorf("failed to generate password: %w", err)
+			results = append(results, result)
+			continue
+		}
+
+		err = c.updateUserPassword(ctx, username, &dbplugin.ChangePassword{
+			NewPassword: password,
+			Statements:  dbplugin.Statements{Commands: statements},
+		})
+		if err != nil {
+			result.Err = fmt.Errorf("failed to rotate password: %w", err)
+			results = append(results, result)
+			continue
+		}
+
+		if c.isRootUser(username) {
+			c.reconnectAsRoot(ctx, password)
+		}
+
+		result.Success = true
+		result.NewPassword = password
+		results = append(results, result)
+	}
+
+	return results
+}
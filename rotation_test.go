@@ -0,0 +1,291 @@
+// Copyright (c) 2024 Elaunira
+// SPDX-License-Identifier: MPL-2.0
+
+package clickhouse
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	clickhousehelper "github.com/elaunira/openbao-plugin-database-clickhouse/testhelpers/clickhouse"
+	"github.com/openbao/openbao/sdk/v2/database/dbplugin/v5"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotationResult_String(t *testing.T) {
+	result := RotationResult{
+		Username:    "v-token-user",
+		Success:     true,
+		NewPassword: "super-secret-password",
+	}
+
+	for _, format := range []string{"%v", "%+v", "%#v", "%s"} {
+		out := fmt.Sprintf(format, result)
+		require.NotContains(t, out, "super-secret-password", "format %s leaked the password", format)
+		require.Contains(t, out, "v-token-user")
+		require.Contains(t, out, "[redacted]")
+	}
+
+	failed := RotationResult{Username: "v-token-user", Err: errors.New("boom")}
+	require.NotContains(t, failed.String(), "[redacted]")
+	require.Contains(t, failed.String(), "boom")
+}
+
+func TestClickhouse_RotateUsers(t *testing.T) {
+	cleanup, connURL := clickhousehelper.PrepareTestContainer(t, false, testAdminUser, testAdminPassword)
+	defer cleanup()
+
+	db := newTestClickhouse(t)
+	err := db.Init(context.Background(), map[string]interface{}{
+		"connection_url": connURL,
+	}, true)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+
+	usernames := []string{"rotate_user_1", "rotate_user_2"}
+	for _, username := range usernames {
+		err = db.executeStatementsWithMap(context.Background(), []string{
+			"CREATE USER IF NOT EXISTS '{{name}}' IDENTIFIED BY '{{password}}'",
+		}, errorModeStop, map[string]string{"name": username, "password": testPassword})
+		require.NoError(t, err)
+	}
+
+	results := db.RotateUsers(context.Background(), append(usernames, "rotate_missing_user"), []string{
+		"ALTER USER '{{name}}' IDENTIFIED BY '{{password}}'",
+	})
+	require.Len(t, results, 3)
+
+	for i, username := range usernames {
+		require.Equal(t, username, results[i].Username)
+		require.True(t, results[i].Success)
+		require.NoError(t, results[i].Err)
+		require.NotEmpty(t, results[i].NewPassword)
+		require.NotContains(t, fmt.Sprintf("%v", results[i]), results[i].NewPassword)
+
+		err = clickhousehelper.TestCredsExist(t, buildTestConnURL(connURL, username, results[i].NewPassword))
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, "rotate_missing_user", results[2].Username)
+	require.False(t, results[2].Success)
+	require.Error(t, results[2].Err)
+	require.Empty(t, results[2].NewPassword)
+}
+
+func TestClickhouse_UpdateUser_RootRotationFailure(t *testing.T) {
+	db := newTestClickhouse(t)
+	db.ping = func(context.Context, *sql.DB) error { return nil }
+	require.NoError(t, db.Init(context.Background(), map[string]interface{}{
+		// Nothing listens on port 1, so every statement fails
+		"connection_url":      "clickhouse://127.0.0.1:1?username={{username}}&password={{password}}",
+		"username":            "admin",
+		"password":            "old-password",
+		"rotation_error_mode": errorModeContinue,
+	}, true))
+	defer func() { _ = db.Close() }()
+
+	statements := dbplugin.Statements{Commands: []string{
+		"ALTER USER '{{username}}' IDENTIFIED BY '{{password}}'; ALTER USER '{{username}}' SETTINGS PROFILE 'admin'",
+	}}
+
+	// Other users follow rotation_error_mode
+	_, err := db.UpdateUser(context.Background(), dbplugin.UpdateUserRequest{
+		Username: "v-token",
+		Password: &dbplugin.ChangePassword{NewPassword: "new-password", Statements: statements},
+	})
+	require.NoError(t, err)
+
+	// The root rotation stops at the first failure and keeps the old password
+	_, err = db.UpdateUser(context.Background(), dbplugin.UpdateUserRequest{
+		Username: "admin",
+		Password: &dbplugin.ChangePassword{NewPassword: "new-password", Statements: statements},
+	})
+	require.ErrorContains(t, err, "statement 1 of 2")
+	require.Equal(t, "old-password", db.Password)
+	require.Contains(t, db.ConnectionURL, "old-password")
+}
+
+func TestClickhouse_RotateUsers_RootRotationFailure(t *testing.T) {
+	db := newTestClickhouse(t)
+	db.ping = func(context.Context, *sql.DB) error { return nil }
+	require.NoError(t, db.Init(context.Background(), map[string]interface{}{
+		// Nothing listens on port 1, so every statement fails
+		"connection_url":      "clickhouse://127.0.0.1:1?username={{username}}&password={{password}}",
+		"username":            "admin",
+		"password":            "old-password",
+		"rotation_error_mode": errorModeContinue,
+	}, true))
+	defer func() { _ = db.Close() }()
+
+	results := db.RotateUsers(context.Background(), []string{"v-token", "admin"}, []string{
+		"ALTER USER '{{username}}' IDENTIFIED BY '{{password}}'; ALTER USER '{{username}}' SETTINGS PROFILE 'admin'",
+	})
+	require.Len(t, results, 2)
+
+	// Other users follow rotation_error_mode
+	require.True(t, results[0].Success)
+
+	// The root rotation stops at the first failure and keeps the old password
+	require.False(t, results[1].Success)
+	require.ErrorContains(t, results[1].Err, "statement 1 of 2")
+	require.Equal(t, "old-password", db.Password)
+	require.Contains(t, db.ConnectionURL, "old-password")
+}
+
+func TestClickhouse_reconnectAsRoot(t *testing.T) {
+	db := newTestClickhouse(t)
+	db.ping = func(context.Context, *sql.DB) error { return nil }
+	require.NoError(t, db.Init(context.Background(), map[string]interface{}{
+		"connection_url": "clickhouse://localhost:9000?username={{username}}&password={{password}}",
+		"username":       "admin",
+		"password":       "old-password",
+	}, true))
+	defer func() { _ = db.Close() }()
+	require.True(t, db.isRootUser("admin"))
+	require.False(t, db.isRootUser("v-token"))
+
+	db.Lock()
+	db.reconnectAsRoot(context.Background(), "new-password")
+	db.Unlock()
+	require.Equal(t, "new-password", db.Password)
+	require.Equal(t, "clickhouse://localhost:9000?username=admin&password=new-password", db.ConnectionURL)
+	require.True(t, db.Initialized())
+
+	// A literal password in the connection_url can't follow the rotation
+	db = newTestClickhouse(t)
+	require.NoError(t, db.Init(context.Background(), map[string]interface{}{
+		"connection_url": "clickhouse://localhost:9000?username=admin&password=old-password",
+		"username":       "admin",
+	}, false))
+	db.Lock()
+	db.reconnectAsRoot(context.Background(), "new-password")
+	db.Unlock()
+	require.Equal(t, "clickhouse://localhost:9000?username=admin&password=old-password", db.ConnectionURL)
+}
+
+func TestClickhouse_reconnectAsRoot_PasswordFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "password")
+	require.NoError(t, os.WriteFile(path, []byte("old-password\n"), 0o600))
+
+	db := newTestClickhouse(t)
+	db.ping = func(context.Context, *sql.DB) error { return nil }
+	require.NoError(t, db.Init(context.Background(), map[string]interface{}{
+		"connection_url": "clickhouse://localhost:9000?username={{username}}&password={{password}}",
+		"username":       "admin",
+		"password_file":  path,
+	}, true))
+	defer func() { _ = db.Close() }()
+
+	// The rotated password replaces password_file
+	db.Lock()
+	db.reconnectAsRoot(context.Background(), "new-password")
+	db.Unlock()
+	require.True(t, db.Initialized())
+	require.Equal(t, "new-password", db.Password)
+	require.Empty(t, db.PasswordFile)
+	require.Equal(t, "clickhouse://localhost:9000?username=admin&password=new-password", db.ConnectionURL)
+
+	// And so does a password given to Reload
+	require.NoError(t, db.Init(context.Background(), map[string]interface{}{
+		"connection_url": "clickhouse://localhost:9000?username={{username}}&password={{password}}",
+		"username":       "admin",
+		"password_file":  path,
+	}, true))
+	require.NoError(t, db.Reload(context.Background(), map[string]interface{}{"password": "reloaded"}))
+	require.True(t, db.Initialized())
+	require.Equal(t, "reloaded", db.Password)
+}
+
+func TestClickhouse_UpdateUser_RootRotation(t *testing.T) {
+	cleanup, connURL := clickhousehelper.PrepareTestContainer(t, false, testAdminUser, testAdminPassword)
+	defer cleanup()
+
+	admin := newTestClickhouse(t)
+	require.NoError(t, admin.Init(context.Background(), map[string]interface{}{
+		"connection_url": connURL,
+	}, true))
+	defer func() { _ = admin.Close() }()
+	err := admin.executeStatementsWithMap(context.Background(), []string{
+		"CREATE USER '{{name}}' IDENTIFIED BY '{{password}}'; GRANT ALL ON *.* TO '{{name}}' WITH GRANT OPTION",
+	}, errorModeStop, map[string]string{"name": "rotating_root", "password": testPassword})
+	require.NoError(t, err)
+
+	u, err := url.Parse(connURL)
+	require.NoError(t, err)
+	u.RawQuery = ""
+	db := newTestClickhouse(t)
+	require.NoError(t, db.Init(context.Background(), map[string]interface{}{
+		"connection_url": u.String() + "?username={{username}}&password={{password}}",
+		"username":       "rotating_root",
+		"password":       testPassword,
+	}, true))
+	defer func() { _ = db.Close() }()
+
+	const newPassword = "rotated-root-password"
+	_, err = db.UpdateUser(context.Background(), dbplugin.UpdateUserRequest{
+		Username: "rotating_root",
+		Password: &dbplugin.ChangePassword{
+			NewPassword: newPassword,
+			Statements: dbplugin.Statements{Commands: []string{
+				"ALTER USER '{{username}}' IDENTIFIED BY '{{password}}'",
+				"ALTER USER '{{username}}' SETTINGS max_execution_time = 60",
+			}},
+		},
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, clickhousehelper.TestCredsExist(t, buildTestConnURL(connURL, "rotating_root", newPassword)))
+	require.Error(t, clickhousehelper.TestCredsExist(t, buildTestConnURL(connURL, "rotating_root", testPassword)))
+
+	// The plugin reconnected with the new password
+	require.Equal(t, newPassword, db.Password)
+	db.Lock()
+	defer db.Unlock()
+	exists, err := db.userExists(context.Background(), "rotating_root")
+	require.NoError(t, err)
+	require.True(t, exists)
+}
+
+func TestClickhouse_RotateUsers_RootRotation(t *testing.T) {
+	cleanup, connURL := clickhousehelper.PrepareTestContainer(t, false, testAdminUser, testAdminPassword)
+	defer cleanup()
+
+	admin := newTestClickhouse(t)
+	require.NoError(t, admin.Init(context.Background(), map[string]interface{}{
+		"connection_url": connURL,
+	}, true))
+	defer func() { _ = admin.Close() }()
+	err := admin.executeStatementsWithMap(context.Background(), []string{
+		"CREATE USER '{{name}}' IDENTIFIED BY '{{password}}'; GRANT ALL ON *.* TO '{{name}}' WITH GRANT OPTION",
+	}, errorModeStop, map[string]string{"name": "batch_root", "password": testPassword})
+	require.NoError(t, err)
+
+	u, err := url.Parse(connURL)
+	require.NoError(t, err)
+	u.RawQuery = ""
+	db := newTestClickhouse(t)
+	require.NoError(t, db.Init(context.Background(), map[string]interface{}{
+		"connection_url": u.String() + "?username={{username}}&password={{password}}",
+		"username":       "batch_root",
+		"password":       testPassword,
+	}, true))
+	defer func() { _ = db.Close() }()
+
+	results := db.RotateUsers(context.Background(), []string{"batch_root"}, nil)
+	require.Len(t, results, 1)
+	require.True(t, results[0].Success, results[0].Err)
+
+	// The plugin reconnected with the new password
+	require.Equal(t, results[0].NewPassword, db.Password)
+	db.Lock()
+	defer db.Unlock()
+	exists, err := db.userExists(context.Background(), "batch_root")
+	require.NoError(t, err)
+	require.True(t, exists)
+}
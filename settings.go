@@ -0,0 +1,77 @@
+// Copyright (c) 2024 Elaunira
+// SPDX-License-Identifier: MPL-2.0
+
+package clickhouse
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// userSettings are ClickHouse settings pinned on a user, such as
+// max_memory_usage, by setting name.
+type userSettings map[string]interface{}
+
+// validate checks that the setting names are safe identifiers and the values
+// scalars, so clause can render them without further checks.
+func (s userSettings) validate() error {
+	for name, value := range s {
+		if !safeIdentifierPattern.MatchString(name) {
+			return fmt.Errorf("setting name %q is not a valid identifier", name)
+		}
+		if _, ok := settingLiteral(value); !ok {
+			return fmt.Errorf("value of setting %q must be a string, number or boolean", name)
+		}
+	}
+	return nil
+}
+
+// clause returns the settings as a SETTINGS list, e.g.
+// "max_memory_usage = 10000000, readonly = 1", sorted by name.
+func (s userSettings) clause() string {
+	names := make([]string, 0, len(s))
+	for name := range s {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		literal, _ := settingLiteral(s[name])
+		parts = append(parts, name+" = "+literal)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// settingLiteral renders a scalar setting value as a SQL literal: numbers as
+// is, booleans as 1 or 0 and strings quoted. It reports false for other
+// values.
+func settingLiteral(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return "'" + escapeClickHouseString(v) + "'", true
+	case bool:
+		if v {
+			return "1", true
+		}
+		return "0", true
+	case int:
+		return strconv.Itoa(v), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case uint64:
+		return strconv.FormatUint(v, 10), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case json.Number:
+		if _, err := v.Float64(); err != nil {
+			return "", false
+		}
+		return v.String(), true
+	default:
+		return "", false
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2024 Elaunira
+// SPDX-License-Identifier: MPL-2.0
+
+package clickhouse
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/openbao/openbao/sdk/v2/database/dbplugin/v5"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_userSettings_clause(t *testing.T) {
+	settings := userSettings{
+		"max_memory_usage":   10000000,
+		"max_execution_time": 30.5,
+		"readonly":           true,
+		"log_comment":        "it's me",
+		"max_threads":        json.Number("8"),
+	}
+	require.NoError(t, settings.validate())
+	require.Equal(t,
+		`log_comment = 'it\'s me', max_execution_time = 30.5, max_memory_usage = 10000000, max_threads = 8, readonly = 1`,
+		settings.clause())
+
+	require.Empty(t, userSettings(nil).clause())
+}
+
+func Test_userSettings_validate(t *testing.T) {
+	tests := []struct {
+		name      string
+		settings  userSettings
+		expectErr string
+	}{
+		{name: "unsafe name", settings: userSettings{"max_memory_usage = 1; DROP": 1}, expectErr: "is not a valid identifier"},
+		{name: "list value", settings: userSettings{"readonly": []string{"1"}}, expectErr: "must be a string, number or boolean"},
+		{name: "map value", settings: userSettings{"readonly": map[string]interface{}{}}, expectErr: "must be a string, number or boolean"},
+		{name: "null value", settings: userSettings{"readonly": nil}, expectErr: "must be a string, number or boolean"},
+		{name: "invalid number", settings: userSettings{"readonly": json.Number("1e")}, expectErr: "must be a string, number or boolean"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.ErrorContains(t, tt.settings.validate(), tt.expectErr)
+		})
+	}
+}
+
+func TestClickhouse_UserSettings(t *testing.T) {
+	db := newTestClickhouse(t)
+	require.NoError(t, db.Init(context.Background(), map[string]interface{}{
+		"connection_url": "clickhouse://localhost:9000",
+		"user_settings": map[string]interface{}{
+			"max_memory_usage": 10000000,
+			"log_comment":      "vault's user",
+		},
+	}, false))
+
+	result, err := db.DryRunNewUser(dbplugin.NewUserRequest{
+		UsernameConfig: dbplugin.UsernameMetadata{DisplayName: "token", RoleName: testRole},
+		Statements: dbplugin.Statements{Commands: []string{
+			"CREATE USER '{{name}}' IDENTIFIED BY '{{password}}'; ALTER USER '{{name}}' SETTINGS {{user_settings}}",
+		}},
+		Password:   testPassword,
+		Expiration: time.Now().Add(time.Hour),
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"CREATE USER '" + result.Username + "' IDENTIFIED BY '[password]'",
+		"ALTER USER '" + result.Username + `' SETTINGS log_comment = 'vault\'s user', max_memory_usage = 10000000`,
+	}, result.Statements)
+
+	err = newTestClickhouse(t).Init(context.Background(), map[string]interface{}{
+		"connection_url": "clickhouse://localhost:9000",
+		"user_settings":  map[string]interface{}{"max memory": 1},
+	}, false)
+	require.ErrorContains(t, err, "invalid user_settings")
+}
@@ -13,18 +13,35 @@ import (
 	"net"
 	"os"
 	"path"
+	"testing"
 	"time"
 )
 
+// GenCACertificates generates CA and server certificates for TLS testing in a
+// temporary directory and returns its path.
+func GenCACertificates(t testing.TB) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := genCACertificates(dir); err != nil {
+		t.Fatalf("unable to generate certificates: %v", err)
+	}
+	return dir
+}
+
 // genCACertificates generates CA and server certificates for TLS testing.
+// Relative paths are resolved against the working directory.
 func genCACertificates(savePath string) error {
-	cwd, err := os.Getwd()
-	if err != nil {
-		return err
+	certPath := savePath
+	if !path.IsAbs(certPath) {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		certPath = path.Join(cwd, savePath)
 	}
 
 	// Create directory if it doesn't exist
-	certPath := path.Join(cwd, savePath)
 	if err := os.MkdirAll(certPath, 0o750); err != nil {
 		return err
 	}
@@ -7,8 +7,12 @@ package clickhousehelper
 import (
 	"context"
 	"database/sql"
+	"fmt"
+	"net"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/openbao/openbao/sdk/v2/helper/docker"
@@ -22,13 +26,21 @@ type Config struct {
 
 var _ docker.ServiceConfig = &Config{}
 
+const imageVersion = "24.8-alpine"
+
 // PrepareTestContainer starts a ClickHouse container for testing.
 func PrepareTestContainer(t *testing.T, useTLS bool, adminUser, adminPassword string) (func(), string) {
+	return PrepareTestContainerWithImage(t, imageVersion, useTLS, adminUser, adminPassword)
+}
+
+// PrepareTestContainerWithImage is PrepareTestContainer running the given
+// clickhouse-server image tag, for tests needing a newer server than the
+// default image. A CLICKHOUSE_URL server is used as is, whatever its version.
+func PrepareTestContainerWithImage(t *testing.T, imageTag string, useTLS bool, adminUser, adminPassword string) (func(), string) {
 	if os.Getenv("CLICKHOUSE_URL") != "" {
 		return func() {}, os.Getenv("CLICKHOUSE_URL")
 	}
 
-	imageVersion := "24.8-alpine"
 	extraCopy := map[string]string{}
 	ports := []string{"9000/tcp"}
 
@@ -41,9 +53,40 @@ func PrepareTestContainer(t *testing.T, useTLS bool, adminUser, adminPassword st
 		ports = []string{"9440/tcp"}
 	}
 
+	return startContainer(t, imageTag, ports, extraCopy, adminUser, adminPassword, func(address string, q url.Values) string {
+		if useTLS {
+			q.Set("secure", "true")
+			q.Set("skip_verify", "true")
+		}
+
+		return (&url.URL{
+			Scheme:   "clickhouse",
+			Host:     address,
+			RawQuery: q.Encode(),
+		}).String()
+	})
+}
+
+// PrepareHTTPTestContainer starts a ClickHouse container for testing and
+// returns a connection URL using the HTTP protocol.
+func PrepareHTTPTestContainer(t *testing.T, adminUser, adminPassword string) (func(), string) {
+	if os.Getenv("CLICKHOUSE_HTTP_URL") != "" {
+		return func() {}, os.Getenv("CLICKHOUSE_HTTP_URL")
+	}
+
+	return startContainer(t, imageVersion, []string{"8123/tcp"}, map[string]string{}, adminUser, adminPassword, func(address string, q url.Values) string {
+		return (&url.URL{
+			Scheme:   "http",
+			Host:     address,
+			RawQuery: q.Encode(),
+		}).String()
+	})
+}
+
+func startContainer(t *testing.T, imageTag string, ports []string, extraCopy map[string]string, adminUser, adminPassword string, buildDSN func(address string, q url.Values) string) (func(), string) {
 	runner, err := docker.NewServiceRunner(docker.RunOptions{
 		ImageRepo:     "clickhouse/clickhouse-server",
-		ImageTag:      imageVersion,
+		ImageTag:      imageTag,
 		ContainerName: "clickhouse-server",
 		Env: []string{
 			"CLICKHOUSE_USER=" + adminUser,
@@ -64,16 +107,7 @@ func PrepareTestContainer(t *testing.T, useTLS bool, adminUser, adminPassword st
 		q.Set("username", adminUser)
 		q.Set("password", adminPassword)
 
-		if useTLS {
-			q.Set("secure", "true")
-			q.Set("skip_verify", "true")
-		}
-
-		dsn := (&url.URL{
-			Scheme:   "clickhouse",
-			Host:     hostIP.Address(),
-			RawQuery: q.Encode(),
-		}).String()
+		dsn := buildDSN(hostIP.Address(), q)
 
 		db, err := sql.Open("clickhouse", dsn)
 		if err != nil {
@@ -106,6 +140,51 @@ func TestCredsExist(_ testing.TB, connURL string) error {
 	return db.PingContext(context.Background())
 }
 
+// CreateRole creates a role and returns a function that drops it.
+func CreateRole(t testing.TB, connURL, name string) func() {
+	t.Helper()
+
+	execAdmin(t, connURL, "CREATE ROLE IF NOT EXISTS "+quoteName(name))
+
+	return func() {
+		t.Helper()
+		execAdmin(t, connURL, "DROP ROLE IF EXISTS "+quoteName(name))
+	}
+}
+
+// GrantRoleToUser grants a role to a user and returns a function that revokes
+// it.
+func GrantRoleToUser(t testing.TB, connURL, role, user string) func() {
+	t.Helper()
+
+	execAdmin(t, connURL, fmt.Sprintf("GRANT %s TO %s", quoteName(role), quoteName(user)))
+
+	return func() {
+		t.Helper()
+		execAdmin(t, connURL, fmt.Sprintf("REVOKE %s FROM %s", quoteName(role), quoteName(user)))
+	}
+}
+
+// execAdmin runs a statement over connURL, failing the test on error.
+func execAdmin(t testing.TB, connURL, query string) {
+	t.Helper()
+
+	db, err := sql.Open("clickhouse", connURL)
+	if err != nil {
+		t.Fatalf("unable to open connection: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	if _, err := db.ExecContext(context.Background(), query); err != nil {
+		t.Fatalf("unable to execute %q: %v", query, err)
+	}
+}
+
+// quoteName quotes a role or user name as a ClickHouse identifier.
+func quoteName(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "\\`") + "`"
+}
+
 // BuildConnString builds a connection string from components.
 func BuildConnString(host string, port int, username, password string, useTLS, skipVerify bool) string {
 	q := make(url.Values)
@@ -121,7 +200,7 @@ func BuildConnString(host string, port int, username, password string, useTLS, s
 
 	return (&url.URL{
 		Scheme:   "clickhouse",
-		Host:     host + ":" + string(rune(port)),
+		Host:     net.JoinHostPort(host, strconv.Itoa(port)),
 		RawQuery: q.Encode(),
 	}).String()
 }
@@ -0,0 +1,52 @@
+// Copyright (c) 2024 Elaunira
+// SPDX-License-Identifier: MPL-2.0
+
+package clickhousehelper
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildConnString(t *testing.T) {
+	connString := BuildConnString("h", 9000, "user", "pass", false, false)
+	require.Contains(t, connString, "h:9000")
+	require.Equal(t, "clickhouse://h:9000?password=pass&username=user", connString)
+
+	connString = BuildConnString("::1", 9440, "user", "pass", true, true)
+	require.Equal(t, "clickhouse://[::1]:9440?password=pass&secure=true&skip_verify=true&username=user", connString)
+}
+
+func TestRoleHelpers(t *testing.T) {
+	cleanup, connURL := PrepareTestContainer(t, false, "default", "password")
+	defer cleanup()
+
+	db, err := sql.Open("clickhouse", connURL)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+
+	count := func(query string, args ...any) uint64 {
+		var n uint64
+		require.NoError(t, db.QueryRowContext(context.Background(), query, args...).Scan(&n))
+		return n
+	}
+
+	dropRole := CreateRole(t, connURL, "helper_role")
+	require.EqualValues(t, 1, count("SELECT count() FROM system.roles WHERE name = ?", "helper_role"))
+
+	execAdmin(t, connURL, "CREATE USER IF NOT EXISTS helper_user IDENTIFIED BY 'helper'")
+	defer execAdmin(t, connURL, "DROP USER IF EXISTS helper_user")
+
+	revoke := GrantRoleToUser(t, connURL, "helper_role", "helper_user")
+	grantQuery := "SELECT count() FROM system.role_grants WHERE user_name = ? AND granted_role_name = ?"
+	require.EqualValues(t, 1, count(grantQuery, "helper_user", "helper_role"))
+
+	revoke()
+	require.EqualValues(t, 0, count(grantQuery, "helper_user", "helper_role"))
+
+	dropRole()
+	require.EqualValues(t, 0, count("SELECT count() FROM system.roles WHERE name = ?", "helper_role"))
+}
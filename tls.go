@@ -0,0 +1,163 @@
+// Copyright (c) 2024 Elaunira
+// SPDX-License-Identifier: MPL-2.0
+
+package clickhouse
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	ch "github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// caFileExtensions are the extensions of the files loaded from a tls_ca_path
+// directory.
+var caFileExtensions = []string{".crt", ".pem"}
+
+// pemHeader starts inline PEM content, telling it apart from a file path.
+const pemHeader = "-----BEGIN"
+
+// configureTLS applies the TLS settings that cannot be expressed in the DSN.
+// They require TLS to be enabled by the connection URL.
+func (c *clickhouseConnectionProducer) configureTLS(opts *ch.Options) error {
+	fields := c.tlsFields()
+	if len(fields) == 0 {
+		return nil
+	}
+
+	if opts.TLS == nil {
+		return fmt.Errorf("%s requires TLS to be enabled", fields[0])
+	}
+
+	if c.TLSServerName != "" {
+		opts.TLS.ServerName = c.TLSServerName
+	}
+
+	if c.TLSCA != "" && c.TLSCAPath != "" {
+		return fmt.Errorf("tls_ca and tls_ca_path are mutually exclusive")
+	}
+	if c.TLSCAPath != "" {
+		pool, err := loadCAPool(c.TLSCAPath)
+		if err != nil {
+			return err
+		}
+		opts.TLS.RootCAs = pool
+	}
+	if c.TLSCA != "" {
+		pem, err := readPEM("tls_ca", c.TLSCA)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no CA certificates found in tls_ca")
+		}
+		opts.TLS.RootCAs = pool
+	}
+
+	if (c.TLSClientCert == "") != (c.TLSClientKey == "") {
+		return fmt.Errorf("tls_client_cert and tls_client_key must be set together")
+	}
+	if c.TLSClientCert != "" {
+		certPEM, err := readPEM("tls_client_cert", c.TLSClientCert)
+		if err != nil {
+			return err
+		}
+		keyPEM, err := readPEM("tls_client_key", c.TLSClientKey)
+		if err != nil {
+			return err
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return fmt.Errorf("invalid tls_client_cert or tls_client_key: %w", err)
+		}
+		opts.TLS.Certificates = []tls.Certificate{cert}
+	}
+
+	return nil
+}
+
+// tlsFields returns the names of the TLS settings applied by configureTLS
+// that are set.
+func (c *clickhouseConnectionProducer) tlsFields() []string {
+	var fields []string
+	for _, f := range []struct{ name, value string }{
+		{"tls_server_name", c.TLSServerName},
+		{"tls_ca_path", c.TLSCAPath},
+		{"tls_ca", c.TLSCA},
+		{"tls_client_cert", c.TLSClientCert},
+		{"tls_client_key", c.TLSClientKey},
+	} {
+		if f.value != "" {
+			fields = append(fields, f.name)
+		}
+	}
+	return fields
+}
+
+// isInlinePEM reports whether value holds PEM content rather than a path.
+func isInlinePEM(value string) bool {
+	return strings.HasPrefix(strings.TrimSpace(value), pemHeader)
+}
+
+// readPEM returns the PEM content of a TLS setting: the value itself when it
+// is inline PEM, such as a certificate stored in OpenBao, or else the content
+// of the file it names. Inline content never appears in the errors.
+func readPEM(field, value string) ([]byte, error) {
+	if isInlinePEM(value) {
+		return []byte(value), nil
+	}
+	pem, err := os.ReadFile(value) //nolint:gosec // Path comes from the operator's configuration
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", field, err)
+	}
+	return pem, nil
+}
+
+// loadCAPool builds a certificate pool from a PEM file, or from every .crt
+// and .pem file in a directory.
+func loadCAPool(path string) (*x509.CertPool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tls_ca_path: %w", err)
+	}
+
+	files := []string{path}
+	if info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tls_ca_path: %w", err)
+		}
+
+		files = files[:0]
+		for _, entry := range entries {
+			ext := strings.ToLower(filepath.Ext(entry.Name()))
+			if entry.Type().IsRegular() && slices.Contains(caFileExtensions, ext) {
+				files = append(files, filepath.Join(path, entry.Name()))
+			}
+		}
+	}
+
+	pool := x509.NewCertPool()
+	loaded := false
+	for _, file := range files {
+		pem, err := os.ReadFile(file) //nolint:gosec // Path comes from the operator's configuration
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate %q: %w", file, err)
+		}
+		if pool.AppendCertsFromPEM(pem) {
+			loaded = true
+		}
+	}
+
+	if !loaded {
+		return nil, fmt.Errorf("no CA certificates found in tls_ca_path %q", path)
+	}
+
+	return pool, nil
+}
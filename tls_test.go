@@ -0,0 +1,251 @@
+// Copyright (c) 2024 Elaunira
+// SPDX-License-Identifier: MPL-2.0
+
+package clickhouse
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	clickhousehelper "github.com/elaunira/openbao-plugin-database-clickhouse/testhelpers/clickhouse"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_loadCAPool(t *testing.T) {
+	certDir := clickhousehelper.GenCACertificates(t)
+
+	// A single file
+	pool, err := loadCAPool(filepath.Join(certDir, "local_ca.crt"))
+	require.NoError(t, err)
+	require.NotNil(t, pool)
+
+	// Every .crt and .pem file in a directory, skipping the keys
+	pool, err = loadCAPool(certDir)
+	require.NoError(t, err)
+	require.NotNil(t, pool)
+
+	// A directory without certificates
+	emptyDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(emptyDir, "notes.txt"), []byte("not a cert"), 0o600))
+	_, err = loadCAPool(emptyDir)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no CA certificates found")
+
+	_, err = loadCAPool(filepath.Join(emptyDir, "missing.pem"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to read tls_ca_path")
+}
+
+func Test_clickhouseConnectionProducer_Init_TLSCAPath(t *testing.T) {
+	certDir := clickhousehelper.GenCACertificates(t)
+
+	c := &clickhouseConnectionProducer{}
+	err := c.Init(context.Background(), map[string]interface{}{
+		"host":        "localhost",
+		"port":        9440,
+		"tls":         true,
+		"tls_ca_path": certDir,
+	}, false)
+	require.NoError(t, err)
+
+	opts, err := c.clientOptions()
+	require.NoError(t, err)
+	require.NotNil(t, opts.TLS.RootCAs)
+
+	c = &clickhouseConnectionProducer{}
+	err = c.Init(context.Background(), map[string]interface{}{
+		"host":        "localhost",
+		"port":        9000,
+		"tls_ca_path": certDir,
+	}, false)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "tls_ca_path requires TLS to be enabled")
+}
+
+func Test_clickhouseConnectionProducer_Init_TLSMaterials(t *testing.T) {
+	certDir := clickhousehelper.GenCACertificates(t)
+	caFile := filepath.Join(certDir, "local_ca.crt")
+	certFile := filepath.Join(certDir, "localnode.crt")
+	keyFile := filepath.Join(certDir, "localnode.key")
+
+	read := func(path string) string {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	tests := []struct {
+		name       string
+		caValue    string
+		certValue  string
+		keyValue   string
+		expectMask bool
+	}{
+		{name: "file paths", caValue: caFile, certValue: certFile, keyValue: keyFile},
+		{name: "inline PEM", caValue: read(caFile), certValue: read(certFile), keyValue: read(keyFile), expectMask: true},
+		{name: "mixed", caValue: "\n" + read(caFile), certValue: certFile, keyValue: read(keyFile), expectMask: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &clickhouseConnectionProducer{}
+			err := c.Init(context.Background(), map[string]interface{}{
+				"host":            "localhost",
+				"port":            9440,
+				"tls":             true,
+				"tls_ca":          tt.caValue,
+				"tls_client_cert": tt.certValue,
+				"tls_client_key":  tt.keyValue,
+			}, false)
+			require.NoError(t, err)
+
+			opts, err := c.clientOptions()
+			require.NoError(t, err)
+			require.NotNil(t, opts.TLS.RootCAs)
+			require.Len(t, opts.TLS.Certificates, 1)
+
+			_, masked := c.SecretValues()[tt.keyValue]
+			require.Equal(t, tt.expectMask, masked)
+		})
+	}
+}
+
+func Test_clickhouseConnectionProducer_Init_TLSMaterials_Errors(t *testing.T) {
+	certDir := clickhousehelper.GenCACertificates(t)
+	key, err := os.ReadFile(filepath.Join(certDir, "localnode.key"))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		conf      map[string]interface{}
+		expectErr string
+	}{
+		{
+			name:      "TLS disabled",
+			conf:      map[string]interface{}{"tls_ca": filepath.Join(certDir, "local_ca.crt")},
+			expectErr: "tls_ca requires TLS to be enabled",
+		},
+		{
+			name: "tls_ca with tls_ca_path",
+			conf: map[string]interface{}{
+				"tls":         true,
+				"tls_ca":      filepath.Join(certDir, "local_ca.crt"),
+				"tls_ca_path": certDir,
+			},
+			expectErr: "mutually exclusive",
+		},
+		{
+			name:      "cert without key",
+			conf:      map[string]interface{}{"tls": true, "tls_client_cert": filepath.Join(certDir, "localnode.crt")},
+			expectErr: "must be set together",
+		},
+		{
+			name: "missing file",
+			conf: map[string]interface{}{
+				"tls":             true,
+				"tls_client_cert": filepath.Join(certDir, "missing.crt"),
+				"tls_client_key":  string(key),
+			},
+			expectErr: "failed to read tls_client_cert",
+		},
+		{
+			name: "mismatched pair",
+			conf: map[string]interface{}{
+				"tls":             true,
+				"tls_client_cert": filepath.Join(certDir, "local_ca.crt"),
+				"tls_client_key":  string(key),
+			},
+			expectErr: "invalid tls_client_cert or tls_client_key",
+		},
+		{
+			name:      "inline CA without certificates",
+			conf:      map[string]interface{}{"tls": true, "tls_ca": "-----BEGIN CERTIFICATE-----\nnot base64\n-----END CERTIFICATE-----\n"},
+			expectErr: "no CA certificates found in tls_ca",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := map[string]interface{}{"host": "localhost", "port": 9440}
+			for k, v := range tt.conf {
+				conf[k] = v
+			}
+			err := (&clickhouseConnectionProducer{}).Init(context.Background(), conf, false)
+			require.ErrorContains(t, err, tt.expectErr)
+			require.NotContains(t, err.Error(), string(key))
+		})
+	}
+}
+
+func Test_clickhouseConnectionProducer_Init_RequireTLS(t *testing.T) {
+	tests := []struct {
+		name      string
+		conf      map[string]interface{}
+		expectErr string
+	}{
+		{
+			name:      "plaintext connection_url",
+			conf:      map[string]interface{}{"connection_url": "clickhouse://localhost:9000?username=admin&password=secret"},
+			expectErr: "require_tls is set but the connection doesn't use TLS",
+		},
+		{
+			name:      "plaintext builder",
+			conf:      map[string]interface{}{"host": "localhost", "port": 9000},
+			expectErr: "require_tls is set but the connection doesn't use TLS",
+		},
+		{
+			name: "plaintext read_connection_url",
+			conf: map[string]interface{}{
+				"connection_url":      "clickhouse://localhost:9440?secure=true",
+				"read_connection_url": "clickhouse://replica:9000",
+			},
+			expectErr: "read_connection_url doesn't use TLS",
+		},
+		{
+			name: "secure connection_url",
+			conf: map[string]interface{}{"connection_url": "clickhouse://localhost:9440?secure=true"},
+		},
+		{
+			name: "https connection_url",
+			conf: map[string]interface{}{"connection_url": "https://localhost:8443?secure=true"},
+		},
+		{
+			name: "builder with tls",
+			conf: map[string]interface{}{"host": "localhost", "port": 9440, "tls": true},
+		},
+		{
+			name:      "plaintext socket",
+			conf:      map[string]interface{}{"socket": "/run/clickhouse.sock"},
+			expectErr: "connections through socket don't use TLS",
+		},
+		{
+			name: "socket with tls",
+			conf: map[string]interface{}{"socket": "/run/clickhouse.sock", "tls": true},
+		},
+		{
+			name: "socket with https",
+			conf: map[string]interface{}{"socket": "/run/clickhouse.sock", "protocol": "http", "tls": true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.conf["require_tls"] = true
+			err := (&clickhouseConnectionProducer{}).Init(context.Background(), tt.conf, false)
+			if tt.expectErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorContains(t, err, tt.expectErr)
+			require.NotContains(t, err.Error(), "secret")
+		})
+	}
+
+	// Without require_tls plaintext stays allowed
+	err := (&clickhouseConnectionProducer{}).Init(context.Background(), map[string]interface{}{
+		"connection_url": "clickhouse://localhost:9000",
+	}, false)
+	require.NoError(t, err)
+}
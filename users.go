@@ -0,0 +1,276 @@
+// Copyright (c) 2024 Elaunira
+// SPDX-License-Identifier: MPL-2.0
+
+package clickhouse
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/openbao/openbao/sdk/v2/database/dbplugin/v5"
+)
+
+// defaultDisableStatement blocks a user from logging in by moving its
+// expiration to the past. It is the auto_expire statement with {{expiration}}
+// set to disableBackdate ago.
+const defaultDisableStatement = autoExpireStatement
+
+// disableBackdate is how far in the past a disabled user expires. A day keeps
+// the expiration in the past whatever the server's time zone.
+const disableBackdate = 24 * time.Hour
+
+// defaultRenameStatement renames a user. {{new_username}} is the new name.
+const defaultRenameStatement = `ALTER USER '{{name}}' RENAME TO '{{new_username}}'`
+
+// defaultPluginUserPrefix is the prefix produced by the default username
+// template.
+const defaultPluginUserPrefix = "v-"
+
+// userExists reports whether a user with the given name exists on the server
+// users are created on. It reads from the primary pool, as the create and
+// delete paths decide on its answer and a replica may lag or not share the
+// access storage. The caller must hold the lock.
+func (c *Clickhouse) userExists(ctx context.Context, username string) (bool, error) {
+	db, err := c.connection(ctx)
+	if err != nil {
+		return false, err
+	}
+	return userExistsOn(ctx, db, username)
+}
+
+// userExistsOn reports whether a user with the given name exists on the
+// server db connects to.
+func userExistsOn(ctx context.Context, db *sql.DB, username string) (bool, error) {
+	var count uint64
+	err := db.QueryRowContext(ctx, "SELECT count() FROM system.users WHERE name = ?", username).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up user: %w", err)
+	}
+
+	return count > 0, nil
+}
+
+// ListPluginUsers returns the names of the users starting with prefix, sorted
+// by name. An empty prefix selects users created with the default username
+// template.
+func (c *Clickhouse) ListPluginUsers(ctx context.Context, prefix string) ([]string, error) {
+	if prefix == "" {
+		prefix = defaultPluginUserPrefix
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	db, err := c.readConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT name FROM system.users WHERE startsWith(name, ?) ORDER BY name", prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var users []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("failed to read user name: %w", err)
+		}
+		users = append(users, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+
+	return users, nil
+}
+
+// grantedRoles returns the roles granted to the user. The caller must hold the
+// lock.
+func (c *Clickhouse) grantedRoles(ctx context.Context, username string) ([]string, error) {
+	db, err := c.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT granted_role_name FROM system.role_grants WHERE user_name = ? ORDER BY granted_role_name", username)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list granted roles: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var roles []string
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return nil, fmt.Errorf("failed to read role name: %w", err)
+		}
+		roles = append(roles, role)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list granted roles: %w", err)
+	}
+
+	return roles, nil
+}
+
+// revokeAllStatements returns the statements stripping every privilege and
+// each of the given roles from the user, quoted in the identifierQuote style.
+// Revoking from a user without grants is a no-op, so the statements are safe
+// to run unconditionally.
+func revokeAllStatements(roles []string, identifierQuote string) []string {
+	statements := []string{requoteNames(revokeAllPrivilegesStatement, identifierQuote)}
+	for _, role := range roles {
+		revoke := fmt.Sprintf("REVOKE %s FROM '{{name}}'", quoteIdentifier(role))
+		statements = append(statements, requoteNames(revoke, identifierQuote))
+	}
+	return statements
+}
+
+// RenameUser renames a user with the given statements, or the default
+// ALTER USER ... RENAME TO statement when none are provided. Statements can
+// reference the current name as {{name}} and the new one as {{new_username}}.
+// The dbplugin interface has no rename operation, so this is only reachable
+// by callers embedding the plugin.
+func (c *Clickhouse) RenameUser(ctx context.Context, username, newUsername string, statements []string) error {
+	if username == "" || newUsername == "" {
+		return fmt.Errorf("both the current and the new username are required")
+	}
+	if username == newUsername {
+		return ErrNoChanges
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if len(statements) == 0 {
+		statements = []string{requoteNames(defaultRenameStatement, c.IdentifierQuote)}
+	}
+
+	c.log().Debug("renaming user", "username", username, "new_username", newUsername)
+
+	err := c.executeStatementsWithMap(ctx, statements, c.RotationErrorMode, map[string]string{
+		"name":         username,
+		"username":     username,
+		"cluster":      c.Cluster,
+		"new_username": newUsername,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to rename user: %w", withAccessManagementGuidance(err))
+	}
+
+	return nil
+}
+
+// RevokeUser disables a user without dropping it, so the account remains in
+// system.users for auditing. It runs the given statements, or else the
+// disable_statement, or else an ALTER USER ... VALID UNTIL in the past.
+// Statements can reference the past expiration as {{expiration}}. The dbplugin
+// interface only knows DeleteUser, so this is only reachable by callers
+// embedding the plugin.
+func (c *Clickhouse) RevokeUser(ctx context.Context, username string, statements []string) error {
+	if username == "" {
+		return fmt.Errorf("username is required")
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.isProtectedUser(username) {
+		return fmt.Errorf("refusing to disable %q: %w", username, ErrProtectedUser)
+	}
+
+	if len(statements) == 0 {
+		statements = c.disableStatements()
+	}
+	if setsValidUntil(statements) && !c.supportsVersion(validUntilVersion) {
+		return fmt.Errorf("%w: VALID UNTIL requires ClickHouse %d.%d or later, server is %s",
+			ErrUnsupportedServerVersion, validUntilVersion[0], validUntilVersion[1], c.version)
+	}
+
+	c.log().Debug("disabling user", "username", username)
+
+	err := c.executeStatementsWithMap(ctx, statements, c.RevocationErrorMode, map[string]string{
+		"name":       username,
+		"username":   username,
+		"cluster":    c.Cluster,
+		"expiration": c.formatExpiration(time.Now().Add(-disableBackdate)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to disable user: %w", withAccessManagementGuidance(err))
+	}
+
+	return nil
+}
+
+// disableStatements returns the disable_statement, or the built-in statement
+// when none is configured.
+func (c *Clickhouse) disableStatements() []string {
+	if c.DisableStatement != "" {
+		return []string{c.DisableStatement}
+	}
+	return []string{requoteNames(defaultDisableStatement, c.IdentifierQuote)}
+}
+
+// defaultAdminUser is the user ClickHouse authenticates a connection as when
+// none is given.
+const defaultAdminUser = "default"
+
+// isProtectedUser reports whether username must never be deleted or disabled:
+// the admin user the plugin connects as, which would lock the plugin out, and
+// the users listed in protected_users. The caller must hold the lock.
+func (c *Clickhouse) isProtectedUser(username string) bool {
+	if username == c.adminUsername() {
+		return true
+	}
+	return slices.Contains(splitList(c.ProtectedUsers), username)
+}
+
+// adminUsername returns the user the plugin connects as: the username, else
+// the one in connection_url, else the ClickHouse default.
+func (c *Clickhouse) adminUsername() string {
+	if c.Username != "" {
+		return c.Username
+	}
+	if u, err := url.Parse(c.ConnectionURL); err == nil {
+		if u.User != nil && u.User.Username() != "" {
+			return u.User.Username()
+		}
+		if name := u.Query().Get("username"); name != "" {
+			return name
+		}
+	}
+	return defaultAdminUser
+}
+
+// DeleteUsers deletes each of the users as DeleteUser does with the default
+// revocation statements. A failure for one user does not stop the deletion of
+// the others; the returned map holds the error of each user that could not be
+// deleted. The error is only set when no deletion could be attempted.
+func (c *Clickhouse) DeleteUsers(ctx context.Context, usernames []string) (map[string]error, error) {
+	c.Lock()
+	initialized := c.initialized
+	c.Unlock()
+	if !initialized {
+		return nil, ErrNotInitialized
+	}
+
+	failed := make(map[string]error)
+	for _, username := range usernames {
+		if err := ctx.Err(); err != nil {
+			failed[username] = err
+			continue
+		}
+		if _, err := c.DeleteUser(ctx, dbplugin.DeleteUserRequest{Username: username}); err != nil {
+			failed[username] = err
+		}
+	}
+
+	return failed, nil
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2024 Elaunira
+// SPDX-License-Identifier: MPL-2.0
+
+package clickhouse
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// validUntilVersion is the first ClickHouse release accepting VALID UNTIL in
+// user statements.
+var validUntilVersion = [2]int{23, 9}
+
+// serverVersion returns the version reported by the server, such as
+// "24.3.2.23".
+func serverVersion(ctx context.Context, db *sql.DB) (string, error) {
+	var version string
+	if err := db.QueryRowContext(ctx, "SELECT version()").Scan(&version); err != nil {
+		return "", fmt.Errorf("failed to query server version: %w", err)
+	}
+	return version, nil
+}
+
+// parseVersion returns the major and minor components of a ClickHouse
+// version.
+func parseVersion(version string) ([2]int, error) {
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return [2]int{}, fmt.Errorf("invalid version %q", version)
+	}
+
+	var parsed [2]int
+	for i := range parsed {
+		n, err := strconv.Atoi(parts[i])
+		if err != nil {
+			return [2]int{}, fmt.Errorf("invalid version %q", version)
+		}
+		parsed[i] = n
+	}
+	return parsed, nil
+}
+
+// supportsVersion reports whether the detected server version is at least
+// minimum. An unknown or unparsable version is assumed to be recent enough,
+// leaving the server to reject what it doesn't support.
+func (c *clickhouseConnectionProducer) supportsVersion(minimum [2]int) bool {
+	if c.version == "" {
+		return true
+	}
+	parsed, err := parseVersion(c.version)
+	if err != nil {
+		return true
+	}
+	return parsed[0] > minimum[0] || parsed[0] == minimum[0] && parsed[1] >= minimum[1]
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2024 Elaunira
+// SPDX-License-Identifier: MPL-2.0
+
+package clickhouse
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	clickhousehelper "github.com/elaunira/openbao-plugin-database-clickhouse/testhelpers/clickhouse"
+	"github.com/openbao/openbao/sdk/v2/database/dbplugin/v5"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseVersion(t *testing.T) {
+	version, err := parseVersion("24.3.2.23")
+	require.NoError(t, err)
+	require.Equal(t, [2]int{24, 3}, version)
+
+	version, err = parseVersion("23.9")
+	require.NoError(t, err)
+	require.Equal(t, [2]int{23, 9}, version)
+
+	_, err = parseVersion("24")
+	require.Error(t, err)
+	_, err = parseVersion("v24.3")
+	require.Error(t, err)
+}
+
+func Test_clickhouseConnectionProducer_supportsVersion(t *testing.T) {
+	c := &clickhouseConnectionProducer{}
+	require.True(t, c.supportsVersion(validUntilVersion), "unknown versions are assumed recent")
+
+	for version, expected := range map[string]bool{
+		"23.8.16.40": false,
+		"22.12.1":    false,
+		"23.9.1.1":   true,
+		"24.1.1":     true,
+		"garbage":    true,
+	} {
+		c.version = version
+		require.Equal(t, expected, c.supportsVersion(validUntilVersion), version)
+	}
+}
+
+func TestClickhouse_ServerVersion(t *testing.T) {
+	db := newTestClickhouse(t)
+	require.NoError(t, db.Init(context.Background(), map[string]interface{}{
+		"connection_url": "clickhouse://localhost:9000",
+	}, false))
+
+	// Nothing is reported until a verified connection detected the version
+	metadata, err := db.Metadata()
+	require.NoError(t, err)
+	require.NotContains(t, metadata, "server_version")
+
+	db.version = "23.8.16.40"
+	metadata, err = db.Metadata()
+	require.NoError(t, err)
+	require.Equal(t, "23.8.16.40", metadata["server_version"])
+
+	// VALID UNTIL is rejected up front on servers that don't support it
+	req := dbplugin.NewUserRequest{
+		UsernameConfig: dbplugin.UsernameMetadata{DisplayName: "token", RoleName: "reader"},
+		Statements: dbplugin.Statements{
+			Commands: []string{"CREATE USER '{{name}}' IDENTIFIED BY '{{password}}' VALID UNTIL '{{expiration}}'"},
+		},
+		Password:   "s3cr3t-pass",
+		Expiration: time.Now().Add(time.Hour),
+	}
+	_, err = db.DryRunNewUser(req)
+	require.ErrorIs(t, err, ErrUnsupportedServerVersion)
+	require.ErrorContains(t, err, "requires ClickHouse 23.9 or later, server is 23.8.16.40")
+
+	req.Statements.Commands = []string{"CREATE USER '{{name}}' IDENTIFIED BY '{{password}}'"}
+	_, err = db.DryRunNewUser(req)
+	require.NoError(t, err)
+}
+
+func TestClickhouse_ServerVersion_Detected(t *testing.T) {
+	cleanup, connURL := clickhousehelper.PrepareTestContainer(t, false, testAdminUser, testAdminPassword)
+	defer cleanup()
+
+	db := newTestClickhouse(t)
+	_, err := db.Initialize(context.Background(), dbplugin.InitializeRequest{
+		Config:           map[string]interface{}{"connection_url": connURL},
+		VerifyConnection: true,
+	})
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+
+	metadata, err := db.Metadata()
+	require.NoError(t, err)
+	version, ok := metadata["server_version"].(string)
+	require.True(t, ok)
+	_, err = parseVersion(version)
+	require.NoError(t, err)
+}